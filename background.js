@@ -85,6 +85,12 @@ function handleRequest(request) {
         .catch(err => sendErr(request.id, err.message))
       break
 
+    case "createWindow":
+      browser.windows.create(request.props)
+        .then((window) => { sendSuccess(request.id, window) })
+        .catch(err => sendErr(request.id, err.message))
+      break
+
     case "duplicate":
       browser.tabs.duplicate(request.tabId, request.props)
         .then((tab) => { sendSuccess(request.id, tab.id) })
@@ -152,14 +158,99 @@ function handleRequest(request) {
         .catch(err => sendErr(request.id, err.message))
       break
 
+    // props: {format, quality, rect, scale}
+    case "captureTab":
+      browser.tabs.captureTab(request.tabId, request.props)
+        .then((dataUrl) => sendSuccess(request.id, { dataUrl: dataUrl }))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    // props: {code | file, allFrames, frameId, matchAboutBlank, runAt}
+    // responds with the result from each frame
+    case "executeScript":
+      browser.tabs.executeScript(request.tabId, request.props)
+        .then((results) => sendSuccess(request.id, results))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "insertCSS":
+      browser.tabs.insertCSS(request.tabId, request.props)
+        .then(() => sendSuccess(request.id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "removeCSS":
+      browser.tabs.removeCSS(request.tabId, request.props)
+        .then(() => sendSuccess(request.id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    // requires "contextualIdentities" permission
+    // props: {name}
+    case "listContainers":
+      browser.contextualIdentities.query(request.props || {})
+        .then((containers) => sendSuccess(request.id, containers))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    // props: {name, color, icon}
+    case "createContainer":
+      browser.contextualIdentities.create(request.props)
+        .then((container) => sendSuccess(request.id, container))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "updateContainer":
+      browser.contextualIdentities.update(request.cookieStoreId, request.props)
+        .then((container) => sendSuccess(request.id, container))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "removeContainer":
+      browser.contextualIdentities.remove(request.cookieStoreId)
+        .then((container) => sendSuccess(request.id, container))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    // requires "downloads" permission
+    // props: {url, filename, saveAs, conflictAction, method, headers, body, ...}
+    case "download":
+      browser.downloads.download(request.props)
+        .then((id) => sendSuccess(request.id, id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    // props: a DownloadQuery
+    case "listDownloads":
+      browser.downloads.search(request.props || {})
+        .then((items) => sendSuccess(request.id, items))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "pauseDownload":
+      browser.downloads.pause(request.downloadId)
+        .then(() => sendSuccess(request.id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "resumeDownload":
+      browser.downloads.resume(request.downloadId)
+        .then(() => sendSuccess(request.id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
+    case "cancelDownload":
+      browser.downloads.cancel(request.downloadId)
+        .then(() => sendSuccess(request.id))
+        .catch(err => sendErr(request.id, err.message))
+      break
+
     default:
       sendErr(request.id, `Action ${request.Action} is unknown`)
   }
-// captureTab
 // captureVisibleTab
 // connect
 // detectLanguage
-// executeScript
 // get
 // getAllInWindow
 // getCurrent
@@ -249,6 +340,62 @@ browser.tabs.onDetached.addListener(
     })
 )
 
+/* changeInfo {contextualIdentity} */
+browser.contextualIdentities.onCreated.addListener(
+  (changeInfo) => sendEvent("containerCreated", changeInfo))
+
+browser.contextualIdentities.onUpdated.addListener(
+  (changeInfo) => sendEvent("containerUpdated", changeInfo))
+
+browser.contextualIdentities.onRemoved.addListener(
+  (changeInfo) => sendEvent("containerRemoved", changeInfo))
+
+browser.downloads.onCreated.addListener(
+  (item) => {
+    sendEvent("downloadCreated", item)
+    watchDownloads()
+  })
+
+/* delta {id, <field>: {previous, current}} */
+browser.downloads.onChanged.addListener(
+  (delta) => sendEvent("downloadChanged", delta))
+
+browser.downloads.onErased.addListener(
+  (id) => sendEvent("downloadErased", { id: id }))
+
+/* onChanged doesn't fire as bytes arrive, so poll while anything is downloading */
+var downloadPoller = null
+
+function watchDownloads() {
+  if (downloadPoller) {
+    return
+  }
+  downloadPoller = setInterval(() => {
+    browser.downloads.search({ state: "in_progress" })
+      .then((items) => {
+        if (items.length === 0) {
+          clearInterval(downloadPoller)
+          downloadPoller = null
+        }
+        items.forEach((item) => sendEvent("downloadProgress", {
+          id: item.id,
+          bytesReceived: item.bytesReceived,
+          totalBytes: item.totalBytes,
+        }))
+      })
+  }, 1000)
+}
+
+/* windowId is browser.windows.WINDOW_ID_NONE (-1) when focus leaves the browser */
+browser.windows.onFocusChanged.addListener(
+  (windowId) => sendEvent("focusChanged", { windowId: windowId })
+)
+
+/* newState is "active", "idle" or "locked"; requires "idle" permission */
+browser.idle.onStateChanged.addListener(
+  (newState) => sendEvent("idleStateChanged", { state: newState })
+)
+
 
 /*
 
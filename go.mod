@@ -5,3 +5,7 @@ go 1.19
 require github.com/google/uuid v1.3.0
 
 require github.com/mattn/go-sqlite3 v1.14.16
+
+require github.com/gorilla/websocket v1.5.0
+
+require github.com/godbus/dbus/v5 v5.1.0
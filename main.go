@@ -2,11 +2,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	tabs "github.com/erik-overdahl/tabs_server/pkg/tabs"
 )
@@ -18,20 +23,136 @@ func main() {
 	}
 	switch cmd {
 	case "gateway":
+		if addr := os.Getenv("TABS_SERVER_ASSET_ADDR"); addr != "" {
+			tabs.GatewayAssetAddr = addr
+		}
+		if addr := os.Getenv("TABS_SERVER_WS_ADDR"); addr != "" {
+			tabs.GatewayWebSocketAddr = addr
+		}
+		if origins := os.Getenv("TABS_SERVER_WS_ORIGINS"); origins != "" {
+			tabs.GatewayWebSocketOrigins = strings.Split(origins, ",")
+		}
+		if addr := os.Getenv("TABS_SERVER_JSONRPC_ADDR"); addr != "" {
+			tabs.GatewayJsonRpcAddr = addr
+		}
+		if os.Getenv("TABS_SERVER_DBUS") != "" {
+			tabs.GatewayDBus = true
+		}
+		if dir := os.Getenv("TABS_SERVER_CAPTURE_DIR"); dir != "" {
+			tabs.CaptureCacheDir = dir
+		}
+		if policy := os.Getenv("TABS_SERVER_INCOGNITO"); policy != "" {
+			tabs.IncognitoPolicy = policy
+		}
+		token, err := tabs.LoadToken()
+		if err != nil {
+			log.Fatalf("Failed to load token: %v", err)
+		}
+		tabs.GatewayToken = token
 		gateway := tabs.MakeGateway()
 		gateway.Start()
+	case "serve-http":
+		// serve-http [ADDR]
+		addr := tabs.HttpApiAddr
+		if len(os.Args) > 2 {
+			addr = os.Args[2]
+		}
+		token, err := tabs.LoadToken()
+		if err != nil {
+			log.Fatalf("Failed to load token: %v", err)
+		}
+		tabs.GatewayToken = token
+		client := tabs.MakeTabsClient()
+		if err := client.ConnectBrowserGateway(); err != nil {
+			log.Fatalf("Failed to connect to gateway: %v", err)
+		}
+		if profile := os.Getenv("TABS_SERVER_PROFILE"); profile != "" {
+			if err := client.Authenticate(profile, os.Getenv("TABS_SERVER_PROFILE_TOKEN")); err != nil {
+				log.Fatalf("Failed to authenticate: %v", err)
+			}
+		}
+		if err := tabs.MakeHttpApi(client).ListenAndServe(addr); err != nil {
+			log.Fatal(err)
+		}
+	case "favicons":
+		if len(os.Args) < 3 || os.Args[2] != "gc" {
+			log.Printf("ERROR: usage: %s favicons gc", os.Args[0])
+			os.Exit(1)
+		}
+		cache, err := tabs.MakeFaviconCache(tabs.FaviconCacheDir)
+		if err != nil {
+			log.Fatalf("Failed to open favicon cache: %v", err)
+		}
+		removed, freed := cache.GC()
+		count, size := cache.Stats()
+		fmt.Printf("Removed %d favicons (%d bytes); %d remain (%d bytes)\n",
+			removed, freed, count, size)
+	case "report":
+		// report [daily|weekly] [--count N] [--by domain|url|title] [--json]
+		period, by, count, asJSON := "daily", "domain", 7, false
+		args := os.Args[2:]
+		for i := 0; i < len(args); i++ {
+			switch args[i] {
+			case "daily", "weekly":
+				period = args[i]
+			case "--count":
+				if i+1 < len(args) {
+					i++
+					count, _ = strconv.Atoi(args[i])
+				}
+			case "--by":
+				if i+1 < len(args) {
+					i++
+					by = args[i]
+				}
+			case "--json":
+				asJSON = true
+			default:
+				log.Fatalf("ERROR: unknown report option '%s'", args[i])
+			}
+		}
+		now := time.Now()
+		// a little more than enough history for count weeks
+		spans, err := tabs.LoadActivity(tabs.ActivityFile, now.AddDate(0, 0, -7*(count+1)), now)
+		if err != nil {
+			log.Fatalf("Failed to read activity: %v", err)
+		}
+		report := tabs.BuildActivityReport(spans, period, by, count, now)
+		if asJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(report)
+		} else {
+			err = report.WriteTable(os.Stdout, 10)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "client":
 		client := tabs.MakeTabsClient()
 		store := tabs.MakeTabStore()
+		// download events, passed on to "downloads watch" while it runs
+		var watchMu sync.Mutex
+		var watchEvents chan tabs.Event
 		go func(s *tabs.TabStore) {
 			log.Println("Listening for updates")
 			for update := range client.Updates {
 				log.Printf("Received: %#v", update)
 				update.Apply(s)
+				watchMu.Lock()
+				if watchEvents != nil {
+					watchEvents <- update
+				}
+				watchMu.Unlock()
 			}
 		}(store)
 
 		client.ConnectBrowserGateway()
+		if profile := os.Getenv("TABS_SERVER_PROFILE"); profile != "" {
+			if err := client.Authenticate(profile, os.Getenv("TABS_SERVER_PROFILE_TOKEN")); err != nil {
+				log.Fatalf("Failed to authenticate: %v", err)
+			}
+		}
 
 		tabList, err := client.GetList()
 		if err != nil {
@@ -44,7 +165,8 @@ func main() {
 		scanner := bufio.NewScanner(os.Stdin)
 		fmt.Print("> ")
 		for scanner.Scan() {
-			input := strings.Split(cleanInput(scanner.Text()), " ")
+			raw := strings.TrimSpace(scanner.Text())
+			input := strings.Split(cleanInput(raw), " ")
 			cmd := input[0]
 			switch cmd {
 			case "list":
@@ -64,12 +186,91 @@ func main() {
 					fmt.Println("SUCCESS")
 				}
 			case "create":
-				url := input[1]
-				if tabId, err := client.Create(tabs.CreateProperties{Url: &url}); err != nil {
+				// create [--container NAME] URL
+				// urls and container names are case sensitive
+				args := strings.Fields(raw)[1:]
+				props := tabs.CreateProperties{}
+				if len(args) > 2 && args[0] == "--container" {
+					cookieStoreId, err := client.ContainerId(args[1])
+					if err != nil {
+						fmt.Println("ERROR:", err)
+						break
+					}
+					props.CookieStoreId = &cookieStoreId
+					args = args[2:]
+				}
+				if len(args) < 1 {
+					fmt.Println("ERROR: usage: create [--container NAME] URL")
+					break
+				}
+				props.Url = &args[0]
+				if tabId, err := client.Create(props); err != nil {
 					fmt.Println("ERROR:", err)
 				} else {
 					fmt.Printf("Created tab (id %d)\n", tabId)
 				}
+			case "containers":
+				containers, err := client.ListContainers("")
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				}
+				for _, c := range containers {
+					fmt.Printf("%s\t%s\t%s\t%s\n", c.CookieStoreId, c.Name, c.Color, c.Icon)
+				}
+			case "container":
+				// container create NAME COLOR ICON | update NAME FIELD VALUE | remove NAME
+				args := strings.Fields(raw)[1:]
+				if len(args) < 2 {
+					fmt.Println("ERROR: usage: container create NAME COLOR ICON | update NAME name|color|icon VALUE | remove NAME")
+					break
+				}
+				var err error
+				switch args[0] {
+				case "create":
+					if len(args) < 4 {
+						fmt.Println("ERROR: usage: container create NAME COLOR ICON")
+						break
+					}
+					var c *tabs.Container
+					if c, err = client.CreateContainer(tabs.ContainerProperties{
+						Name: &args[1], Color: &args[2], Icon: &args[3],
+					}); err == nil {
+						fmt.Printf("Created container %s\n", c.CookieStoreId)
+					}
+				case "update":
+					if len(args) < 4 {
+						fmt.Println("ERROR: usage: container update NAME name|color|icon VALUE")
+						break
+					}
+					var cookieStoreId string
+					if cookieStoreId, err = client.ContainerId(args[1]); err != nil {
+						break
+					}
+					props := tabs.ContainerProperties{}
+					switch args[2] {
+					case "name":
+						props.Name = &args[3]
+					case "color":
+						props.Color = &args[3]
+					case "icon":
+						props.Icon = &args[3]
+					default:
+						err = fmt.Errorf("Unknown container field %s", args[2])
+					}
+					if err == nil {
+						_, err = client.UpdateContainer(cookieStoreId, props)
+					}
+				case "remove":
+					var cookieStoreId string
+					if cookieStoreId, err = client.ContainerId(args[1]); err == nil {
+						err = client.RemoveContainer(cookieStoreId)
+					}
+				default:
+					err = fmt.Errorf("Unknown container command %s", args[0])
+				}
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				}
 			case "duplicate":
 				tabId, _ := strconv.Atoi(input[1])
 				if tabId, err := client.Duplicate(tabId, nil); err != nil {
@@ -143,7 +344,349 @@ func main() {
 				} else {
 					fmt.Println("SUCCESS")
 				}
-
+			case "capture":
+				tabId, _ := strconv.Atoi(input[1])
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				capture, err := client.Capture(ctx, tabId, nil)
+				cancel()
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					break
+				}
+				filename := fmt.Sprintf("tab-%d.%s", tabId, capture.Format)
+				if len(input) > 2 {
+					filename = input[2]
+				}
+				if err := os.WriteFile(filename, capture.Data, 0644); err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Println("Wrote", filename)
+				}
+			case "eval":
+				// the script is case sensitive, so take it from the raw input
+				args := strings.SplitN(raw, " ", 3)
+				if len(args) < 3 {
+					fmt.Println("ERROR: usage: eval TABID CODE")
+					break
+				}
+				tabId, _ := strconv.Atoi(args[1])
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				results, err := client.ExecuteScript(ctx, tabId, tabs.InjectDetails{Code: &args[2]})
+				cancel()
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					break
+				}
+				for _, result := range results {
+					fmt.Println(string(result))
+				}
+			case "extract":
+				tabId, _ := strconv.Atoi(input[1])
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				content, err := client.Extract(ctx, tabId)
+				cancel()
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Print(content.Markdown())
+				}
+			case "workspace":
+				if len(input) < 2 || (input[1] != "list" && len(input) < 3) {
+					fmt.Println("ERROR: usage: workspace save NAME [FILTER] | restore NAME | list")
+					break
+				}
+				switch input[1] {
+				case "list":
+					names, err := tabs.ListWorkspaces()
+					if err != nil {
+						fmt.Println("ERROR:", err)
+					}
+					for _, name := range names {
+						fmt.Println(name)
+					}
+				case "save":
+					var filter func(*tabs.Tab) bool
+					if len(input) > 3 {
+						filter = tabs.TabFilter(strings.Join(input[3:], " "))
+					}
+					ws := store.Workspace(input[2], filter)
+					if err := tabs.SaveWorkspace(ws); err != nil {
+						fmt.Println("ERROR:", err)
+					} else {
+						fmt.Printf("Saved %d windows to workspace %s\n", len(ws.Windows), ws.Name)
+					}
+				case "restore":
+					ws, err := tabs.LoadWorkspace(input[2])
+					if err != nil {
+						fmt.Println("ERROR:", err)
+					} else if err := client.RestoreWorkspace(ws); err != nil {
+						fmt.Println("ERROR:", err)
+					} else {
+						fmt.Println("SUCCESS")
+					}
+				default:
+					fmt.Println("ERROR: Unknown workspace command:", input[1])
+				}
+			case "export":
+				// export FORMAT [--favicons] [FILE]
+				args := strings.Fields(raw)[1:]
+				if len(args) < 1 {
+					fmt.Println("ERROR: usage: export markdown|org|html|json [--favicons] [FILE]")
+					break
+				}
+				exporter, exists := tabs.Exporters[strings.ToLower(args[0])]
+				if !exists {
+					fmt.Println("ERROR: Unknown export format:", args[0])
+					break
+				}
+				opts := tabs.ExportOptions{}
+				filename := ""
+				for _, arg := range args[1:] {
+					if arg == "--favicons" {
+						opts.Favicons = true
+					} else {
+						filename = arg
+					}
+				}
+				if filename == "" {
+					if err := exporter(os.Stdout, store, opts); err != nil {
+						fmt.Println("ERROR:", err)
+					}
+					break
+				}
+				f, err := os.Create(filename)
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					break
+				}
+				err = exporter(f, store, opts)
+				if closeErr := f.Close(); err == nil {
+					err = closeErr
+				}
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Println("Wrote", filename)
+				}
+			case "import":
+				// import FORMAT|auto FILE [--window ID] [--new-windows] [--no-discard] [--pin] [--batch N]
+				args := strings.Fields(raw)[1:]
+				if len(args) < 2 {
+					fmt.Println("ERROR: usage: import onetab|markdown|urls|html|json|auto FILE [--window ID] [--new-windows] [--no-discard] [--pin] [--batch N]")
+					break
+				}
+				data, err := os.ReadFile(args[1])
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					break
+				}
+				format := strings.ToLower(args[0])
+				if format == "auto" {
+					format = tabs.DetectImportFormat(data)
+				}
+				importer, exists := tabs.Importers[format]
+				if !exists {
+					fmt.Println("ERROR: Unknown import format:", args[0])
+					break
+				}
+				opts := tabs.OpenOptions{Discarded: true, BatchDelay: time.Second}
+				for i := 2; i < len(args); i++ {
+					switch args[i] {
+					case "--window":
+						if i+1 < len(args) {
+							i++
+							windowId, _ := strconv.Atoi(args[i])
+							opts.WindowId = &windowId
+						}
+					case "--new-windows":
+						opts.NewWindows = true
+					case "--no-discard":
+						opts.Discarded = false
+					case "--pin":
+						opts.Pinned = true
+					case "--batch":
+						if i+1 < len(args) {
+							i++
+							opts.BatchSize, _ = strconv.Atoi(args[i])
+						}
+					default:
+						fmt.Println("WARNING: ignoring unknown option", args[i])
+					}
+				}
+				ws, err := importer(bytes.NewReader(data))
+				if err != nil {
+					fmt.Println("ERROR:", err)
+					break
+				}
+				count := 0
+				for _, window := range ws.Windows {
+					count += len(window.Tabs)
+				}
+				fmt.Printf("Opening %d tabs from %s (%s)\n", count, args[1], format)
+				if err := client.OpenWorkspace(ws, opts); err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Println("SUCCESS")
+				}
+			case "dedupe":
+				groups := store.Duplicates()
+				for _, group := range groups {
+					fmt.Printf("keep   %d.%d\t%s\n", group[0].WindowId, group[0].ID, group[0].Url)
+					for _, tab := range group[1:] {
+						action := "close"
+						if tab.Pinned {
+							action = "pinned"
+						}
+						fmt.Printf("%-6s %d.%d\t%s\n", action, tab.WindowId, tab.ID, tab.Url)
+					}
+				}
+				if len(input) > 1 && input[1] == "--dry-run" {
+					fmt.Printf("Would close %d tabs\n", len(tabs.DuplicatesToClose(groups)))
+				} else if closed, err := client.Dedupe(store); err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Printf("Closed %d tabs\n", len(closed))
+				}
+			case "groups":
+				groups, err := client.ListGroups()
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				}
+				for _, group := range groups {
+					fmt.Printf("%s\t%d tabs\tshowing in %v\n", group.Name, len(group.TabIds), group.ActiveIn)
+				}
+			case "group":
+				// group create NAME | assign NAME TABID... | ungroup TABID... |
+				// switch WINDOWID [NAME] | remove NAME
+				usage := "group create NAME | assign NAME TABID... | ungroup TABID... | switch WINDOWID [NAME] | remove NAME"
+				args := strings.Fields(raw)[1:]
+				if len(args) < 2 {
+					fmt.Println("ERROR: usage:", usage)
+					break
+				}
+				var err error
+				switch args[0] {
+				case "create":
+					_, err = client.CreateGroup(args[1])
+				case "assign", "ungroup":
+					name, ids := "", args[1:]
+					if args[0] == "assign" {
+						name, ids = args[1], args[2:]
+					}
+					tabIds := make([]int, 0, len(ids))
+					for _, id := range ids {
+						tabId, convErr := strconv.Atoi(id)
+						if convErr != nil {
+							err = convErr
+							break
+						}
+						tabIds = append(tabIds, tabId)
+					}
+					if err == nil && len(tabIds) == 0 {
+						err = fmt.Errorf("usage: %s", usage)
+					}
+					if err == nil {
+						_, err = client.AssignGroup(name, tabIds...)
+					}
+				case "switch":
+					var windowId int
+					if windowId, err = strconv.Atoi(args[1]); err != nil {
+						break
+					}
+					name := ""
+					if len(args) > 2 {
+						name = args[2]
+					}
+					_, err = client.SwitchGroup(windowId, name)
+				case "remove":
+					_, err = client.RemoveGroup(args[1])
+				default:
+					err = fmt.Errorf("usage: %s", usage)
+				}
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				}
+			case "download":
+				// download URL [FILENAME]
+				args := strings.Fields(raw)[1:]
+				if len(args) < 1 {
+					fmt.Println("ERROR: usage: download URL [FILENAME]")
+					break
+				}
+				opts := tabs.DownloadOptions{Url: args[0]}
+				if len(args) > 1 {
+					opts.Filename = &args[1]
+				}
+				if id, err := client.Download(opts); err != nil {
+					fmt.Println("ERROR:", err)
+				} else {
+					fmt.Printf("Started download (id %d)\n", id)
+				}
+			case "downloads":
+				// downloads [watch ID | pause ID | resume ID | cancel ID]
+				if len(input) < 2 {
+					items, err := client.ListDownloads(&tabs.DownloadQuery{
+						Limit:   ptr(20),
+						OrderBy: []string{"-startTime"},
+					})
+					if err != nil {
+						fmt.Println("ERROR:", err)
+					}
+					for _, item := range items {
+						fmt.Printf("%d\t%s\t%s\t%s\n", item.ID, item.State, item.Progress(), item.Filename)
+					}
+					break
+				}
+				if len(input) < 3 {
+					fmt.Println("ERROR: usage: downloads [watch|pause|resume|cancel ID]")
+					break
+				}
+				id, _ := strconv.Atoi(input[2])
+				var err error
+				switch input[1] {
+				case "watch":
+					events := make(chan tabs.Event)
+					watchMu.Lock()
+					watchEvents = events
+					watchMu.Unlock()
+					var item *tabs.DownloadItem
+					item, err = client.WaitDownload(context.Background(), id, events, func(item *tabs.DownloadItem) {
+						fmt.Printf("\r\033[K%s  %s", item.State, item.Progress())
+					})
+					// an event may be on its way in with watchMu held, so
+					// take events until we have stopped passing them on
+					done := make(chan struct{})
+					go func() {
+						for {
+							select {
+							case <-events:
+							case <-done:
+								return
+							}
+						}
+					}()
+					watchMu.Lock()
+					watchEvents = nil
+					watchMu.Unlock()
+					close(done)
+					fmt.Println()
+					if err == nil && item.State != "complete" {
+						err = fmt.Errorf("Download %s: %s", item.State, item.Error)
+					} else if err == nil {
+						fmt.Println("Saved", item.Filename)
+					}
+				case "pause":
+					err = client.PauseDownload(id)
+				case "resume":
+					err = client.ResumeDownload(id)
+				case "cancel":
+					err = client.CancelDownload(id)
+				default:
+					err = fmt.Errorf("Unknown downloads command %s", input[1])
+				}
+				if err != nil {
+					fmt.Println("ERROR:", err)
+				}
 			case "exit":
 				fmt.Println("Goodbye")
 				os.Exit(0)
@@ -158,6 +701,8 @@ func main() {
 	}
 }
 
+func ptr[T any](v T) *T { return &v }
+
 func cleanInput(text string) string {
 	output := strings.TrimSpace(text)
 	output = strings.ToLower(output)
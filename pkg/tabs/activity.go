@@ -0,0 +1,318 @@
+package tabs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ActivityFile = filepath.Join(dataDir(), "activity.jsonl")
+	// how often the span in progress is written out so that a crash
+	// loses at most this much
+	ActivityCheckpointInterval = time.Minute
+	// spans shorter than this (tab flicking) are not recorded
+	activityMinSpan = time.Second
+)
+
+// The browser window with focus changed; WindowId is -1 when no browser
+// window has focus
+type FocusChangedMsg struct {
+	WindowId int `json:"windowId"`
+}
+
+func (_ *FocusChangedMsg) Name() string {
+	return "focusChanged"
+}
+
+func (_ *FocusChangedMsg) Apply(_ *TabStore) error {
+	return nil
+}
+
+// The user went idle or came back; State is active, idle or locked
+type IdleStateMsg struct {
+	State string `json:"state"`
+}
+
+func (_ *IdleStateMsg) Name() string {
+	return "idleStateChanged"
+}
+
+func (_ *IdleStateMsg) Apply(_ *TabStore) error {
+	return nil
+}
+
+// A stretch of time the user spent looking at one page
+type ActivitySpan struct {
+	Start   time.Time `json:"start"`
+	Seconds float64   `json:"seconds"`
+	TabId   int       `json:"tabId"`
+	Url     string    `json:"url"`
+	Title   string    `json:"title"`
+}
+
+// Accumulates time spent in the active tab of the focused window while
+// the user is not idle, appending finished spans to ActivityFile
+type activityTracker struct {
+	filename      string
+	focusedWindow int
+	idle          bool
+	// nil when nothing is being watched
+	current *ActivitySpan
+}
+
+func makeActivityTracker(filename string) *activityTracker {
+	return &activityTracker{filename: filename}
+}
+
+// updates the tracker after event has been applied to store
+// must be called from the gateway's event loop
+func (t *activityTracker) observe(store *TabStore, event Event, now time.Time) {
+	switch e := event.(type) {
+	case *FocusChangedMsg:
+		t.focusedWindow = e.WindowId
+	case *IdleStateMsg:
+		t.idle = e.State != "active"
+	case *ActivatedMsg:
+		// we don't learn which window has focus at startup, so assume it
+		// is the one the user is switching tabs in
+		if t.focusedWindow == 0 {
+			t.focusedWindow = e.WindowId
+		}
+	}
+	t.update(store, now)
+}
+
+// starts tracking whatever the user is looking at in store
+func (t *activityTracker) start(store *TabStore, now time.Time) {
+	var latest *Tab
+	for _, tab := range store.Open {
+		if tab.Active && (latest == nil || tab.LastAccessed > latest.LastAccessed) {
+			latest = tab
+		}
+	}
+	if latest != nil {
+		t.focusedWindow = latest.WindowId
+	}
+	t.update(store, now)
+}
+
+func (t *activityTracker) watching(store *TabStore) *Tab {
+	if t.idle || t.focusedWindow <= 0 {
+		return nil
+	}
+	for _, tab := range store.Open {
+		if tab.Active && tab.WindowId == t.focusedWindow && !tab.Incognito {
+			return tab
+		}
+	}
+	return nil
+}
+
+func (t *activityTracker) update(store *TabStore, now time.Time) {
+	tab := t.watching(store)
+	if t.current != nil && tab != nil && t.current.TabId == tab.ID && t.current.Url == tab.Url {
+		t.current.Title = tab.Title
+		return
+	}
+	t.finish(now)
+	if tab != nil {
+		t.current = &ActivitySpan{Start: now, TabId: tab.ID, Url: tab.Url, Title: tab.Title}
+	}
+}
+
+// writes out the span in progress and starts a new one for the same page
+func (t *activityTracker) checkpoint(now time.Time) {
+	if t.current == nil {
+		return
+	}
+	span := *t.current
+	t.finish(now)
+	span.Start = now
+	t.current = &span
+}
+
+func (t *activityTracker) finish(now time.Time) {
+	span := t.current
+	t.current = nil
+	if span == nil {
+		return
+	}
+	duration := now.Sub(span.Start)
+	if duration < activityMinSpan {
+		return
+	}
+	span.Seconds = duration.Seconds()
+	if err := appendActivity(t.filename, span); err != nil {
+		log.Printf("ERROR: failed to record activity: %v", err)
+	}
+}
+
+func appendActivity(filename string, span *ActivitySpan) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(span)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reads the spans that started in [from, to)
+func LoadActivity(filename string, from, to time.Time) ([]ActivitySpan, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readActivity(f, from, to)
+}
+
+func readActivity(r io.Reader, from, to time.Time) ([]ActivitySpan, error) {
+	var spans []ActivitySpan
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var span ActivitySpan
+		if err := json.Unmarshal(scanner.Bytes(), &span); err != nil {
+			// a line torn by a crash shouldn't hide the rest
+			continue
+		}
+		if !span.Start.Before(from) && span.Start.Before(to) {
+			spans = append(spans, span)
+		}
+	}
+	return spans, scanner.Err()
+}
+
+type ActivityEntry struct {
+	Key     string  `json:"key"`
+	Seconds float64 `json:"seconds"`
+}
+
+type ActivityBucket struct {
+	Start   time.Time       `json:"start"`
+	Seconds float64         `json:"seconds"`
+	Entries []ActivityEntry `json:"entries"`
+}
+
+type ActivityReport struct {
+	// "daily" or "weekly"
+	Period  string           `json:"period"`
+	By      string           `json:"by"`
+	Buckets []ActivityBucket `json:"buckets"`
+}
+
+func activityKey(span ActivitySpan, by string) string {
+	switch by {
+	case "url":
+		return span.Url
+	case "title":
+		if span.Title != "" {
+			return span.Title
+		}
+		return span.Url
+	}
+	if u, err := url.Parse(span.Url); err == nil && u.Host != "" {
+		return strings.TrimPrefix(u.Hostname(), "www.")
+	}
+	return span.Url
+}
+
+// returns the midnight starting the day or the Monday starting the week
+// that t falls in
+func bucketStart(t time.Time, period string) time.Time {
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	if period == "weekly" {
+		offset := (int(day.Weekday()) + 6) % 7
+		return day.AddDate(0, 0, -offset)
+	}
+	return day
+}
+
+// totals the time in the last count days or weeks ending with now,
+// grouping by domain, url or title
+func BuildActivityReport(spans []ActivitySpan, period, by string, count int, now time.Time) *ActivityReport {
+	report := &ActivityReport{Period: period, By: by, Buckets: []ActivityBucket{}}
+	step := func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }
+	if period == "weekly" {
+		step = func(t time.Time) time.Time { return t.AddDate(0, 0, 7) }
+	}
+	first := bucketStart(now, period)
+	for i := 1; i < count; i++ {
+		first = bucketStart(first.AddDate(0, 0, -1), period)
+	}
+	totals := make(map[time.Time]map[string]float64)
+	for _, span := range spans {
+		start := bucketStart(span.Start.In(now.Location()), period)
+		if start.Before(first) {
+			continue
+		}
+		if totals[start] == nil {
+			totals[start] = make(map[string]float64)
+		}
+		totals[start][activityKey(span, by)] += span.Seconds
+	}
+	for start := first; !start.After(now); start = step(start) {
+		bucket := ActivityBucket{Start: start, Entries: []ActivityEntry{}}
+		for key, seconds := range totals[start] {
+			bucket.Entries = append(bucket.Entries, ActivityEntry{Key: key, Seconds: seconds})
+			bucket.Seconds += seconds
+		}
+		sort.Slice(bucket.Entries, func(i, j int) bool {
+			return bucket.Entries[i].Seconds > bucket.Entries[j].Seconds
+		})
+		report.Buckets = append(report.Buckets, bucket)
+	}
+	return report
+}
+
+// writes the report as a plain text table, limiting each bucket to top entries
+func (r *ActivityReport) WriteTable(w io.Writer, top int) error {
+	for _, bucket := range r.Buckets {
+		label := bucket.Start.Format("2006-01-02 Mon")
+		if r.Period == "weekly" {
+			label = "week of " + bucket.Start.Format("2006-01-02")
+		}
+		if _, err := fmt.Fprintf(w, "%s\t%s\n", label, formatSeconds(bucket.Seconds)); err != nil {
+			return err
+		}
+		for i, entry := range bucket.Entries {
+			if top > 0 && i >= top {
+				break
+			}
+			if _, err := fmt.Fprintf(w, "  %8s  %s\n", formatSeconds(entry.Seconds), entry.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func formatSeconds(seconds float64) string {
+	d := time.Duration(seconds) * time.Second
+	if d < time.Minute {
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+	return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+}
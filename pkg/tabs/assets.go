@@ -0,0 +1,105 @@
+package tabs
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// address for serving favicons and other assets over http
+	// e.g. "127.0.0.1:7071"; empty disables the listener
+	GatewayAssetAddr = ""
+)
+
+// Serves cached files at /{prefix}/{hash} on a loopback listener so that
+// clients without access to our filesystem can display them
+// Requests are held to the same Host and token checks as the http api
+type assetServer struct {
+	baseUrl string
+	// the port we listen on, which the Host header must match
+	port   string
+	caches map[string]*FileCache
+}
+
+func startAssetServer(addr string, caches map[string]*FileCache) (*assetServer, error) {
+	l, err := listenLoopback(addr)
+	if err != nil {
+		return nil, err
+	}
+	server := &assetServer{
+		baseUrl: "http://" + l.Addr().String(),
+		caches:  caches,
+	}
+	_, server.port, _ = net.SplitHostPort(l.Addr().String())
+	mux := http.NewServeMux()
+	for prefix := range caches {
+		mux.HandleFunc("/"+prefix+"/", server.serve)
+	}
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			log.Printf("ERROR: asset server: %v", err)
+		}
+	}()
+	log.Printf("Serving assets at %s", server.baseUrl)
+	warnNoToken("asset server", addr)
+	return server, nil
+}
+
+// returns the url the asset with this hash is served at
+func (s *assetServer) Url(prefix, hash string) string {
+	return fmt.Sprintf("%s/%s/%s", s.baseUrl, prefix, hash)
+}
+
+func (s *assetServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !allowedHost(r.Host, s.port) {
+		http.Error(w, fmt.Sprintf("Host %q not allowed", r.Host), http.StatusForbidden)
+		return
+	}
+	if !bearerAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	cache, exists := s.caches[parts[0]]
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	filename, exists := cache.Lookup(parts[1])
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// files never change in place
+	w.Header().Set("Cache-Control", "private, max-age=86400, immutable")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// svg icons may carry scripts
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'")
+	// ServeContent picks the content type from the extension
+	http.ServeContent(w, r, filepath.Base(filename), info.ModTime(), f)
+}
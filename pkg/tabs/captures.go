@@ -0,0 +1,72 @@
+package tabs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+var (
+	// directory the gateway writes tab captures into
+	// empty disables caching; captures are then only returned to the client
+	CaptureCacheDir            = ""
+	CaptureCacheMaxBytes int64 = 200 << 20
+	CaptureCacheMaxAge         = 7 * 24 * time.Hour
+)
+
+func MakeCaptureCache(dir string) (*FileCache, error) {
+	return makeFileCache(dir, CaptureCacheMaxBytes, CaptureCacheMaxAge)
+}
+
+// writes the capture in a captureTab response to the cache and adds
+// its location to the response before passing it on
+func (g *Gateway) cacheCapture(in <-chan *Message, out chan<- *Message) {
+	msg := <-in
+	if err := g.storeCapture(msg.Response); err != nil {
+		log.Printf("ERROR: failed to cache capture: %v", err)
+	}
+	out <- msg
+}
+
+func (g *Gateway) storeCapture(response *Response) error {
+	if response == nil || response.Status != "success" {
+		return nil
+	}
+	var capture Capture
+	if err := json.Unmarshal(response.Info, &capture); err != nil {
+		return err
+	}
+	data, ext, err := decodeDataUrl(capture.DataUrl)
+	if err != nil {
+		return err
+	}
+	// unlike favicons, captures are keyed by a random id, so that their urls
+	// can't be worked out from what the page looked like
+	id, err := randomId()
+	if err != nil {
+		return err
+	}
+	if capture.File, err = g.captures.Store(id, ext, data); err != nil {
+		return err
+	}
+	if g.assets != nil {
+		capture.FileUrl = g.assets.Url("capture", id)
+	}
+	info, err := json.Marshal(&capture)
+	if err != nil {
+		return err
+	}
+	response.Info = info
+	return nil
+}
+
+// returns 128 random bits in hex
+func randomId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
@@ -8,6 +8,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -27,7 +28,7 @@ type CreateProperties struct {
 	Active           *bool   `json:"active,omitempty"`
 	Pinned           *bool   `json:"pinned,omitempty"`
 	OpenerTabId      *int    `json:"openerTabId,omitempty"`
-	CookieStoreId    *int    `json:"cookieStoreId,omitempty"`
+	CookieStoreId    *string `json:"cookieStoreId,omitempty"`
 	OpenInReaderMode *bool   `json:"openInReaderMode,omitempty"`
 	Discarded        *bool   `json:"discarded,omitempty"`
 	Title            *string `json:"title,omitempty"`
@@ -59,10 +60,56 @@ type ReloadProperties struct {
 	BypassCache bool `json:"bypassCache,omitempty"`
 }
 
+type Window struct {
+	ID   int    `json:"id"`
+	Tabs []*Tab `json:"tabs"`
+}
+
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+type ImageDetails struct {
+	// "png" or "jpeg"
+	Format *string `json:"format,omitempty"`
+	// jpeg quality, 0-100
+	Quality *int     `json:"quality,omitempty"`
+	Rect    *Rect    `json:"rect,omitempty"`
+	Scale   *float64 `json:"scale,omitempty"`
+}
+
+// Exactly one of Code or File should be set
+type InjectDetails struct {
+	Code            *string `json:"code,omitempty"`
+	File            *string `json:"file,omitempty"`
+	AllFrames       *bool   `json:"allFrames,omitempty"`
+	FrameId         *int    `json:"frameId,omitempty"`
+	MatchAboutBlank *bool   `json:"matchAboutBlank,omitempty"`
+	// "document_start", "document_end" or "document_idle"
+	RunAt *string `json:"runAt,omitempty"`
+	// "author" or "user"; only used for css
+	CssOrigin *string `json:"cssOrigin,omitempty"`
+}
+
+// A screenshot of a tab
+// File and FileUrl are filled in when the gateway caches captures
+type Capture struct {
+	Data    []byte `json:"-"`
+	Format  string `json:"-"`
+	DataUrl string `json:"dataUrl"`
+	File    string `json:"file,omitempty"`
+	FileUrl string `json:"fileUrl,omitempty"`
+}
+
 type TabsClient struct {
 	Updates     chan Event
 	gatewayConn net.Conn
-	requests    map[uuid.UUID]chan *Response
+	// guards requests and writes to gatewayConn
+	mu       sync.Mutex
+	requests map[uuid.UUID]chan *Response
 }
 
 func MakeTabsClient() *TabsClient {
@@ -99,8 +146,8 @@ func (client *TabsClient) GetList() ([]*Tab, error) {
 func (client *TabsClient) Activate(tabId int) error {
 	if response, err := client.Request(&Request{
 		Method: "update",
-		TabId: tabId,
-		Props: &UpdateProperties{Active: ptr(true)},
+		TabId:  tabId,
+		Props:  &UpdateProperties{Active: ptr(true)},
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -112,7 +159,7 @@ func (client *TabsClient) Activate(tabId int) error {
 func (client *TabsClient) Create(props CreateProperties) (int, error) {
 	response, err := client.Request(&Request{
 		Method: "create",
-		Props: &props,
+		Props:  &props,
 	})
 	if err != nil {
 		return -1, err
@@ -126,11 +173,27 @@ func (client *TabsClient) Create(props CreateProperties) (int, error) {
 	return newTabId, nil
 }
 
+func (client *TabsClient) CreateWindow() (*Window, error) {
+	response, err := client.Request(&Request{
+		Method: "createWindow",
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var window Window
+	if err := json.Unmarshal(response.Info, &window); err != nil {
+		return nil, err
+	}
+	return &window, nil
+}
+
 func (client *TabsClient) Duplicate(tabId int, props *DuplicateProperties) (int, error) {
 	response, err := client.Request(&Request{
 		Method: "duplicate",
-		TabId: tabId,
-		Props: props,
+		TabId:  tabId,
+		Props:  props,
 	})
 	if err != nil {
 		return -1, err
@@ -147,7 +210,8 @@ func (client *TabsClient) Duplicate(tabId int, props *DuplicateProperties) (int,
 func (client *TabsClient) Update(tabId int, props *UpdateProperties) error {
 	if response, err := client.Request(&Request{
 		Method: "update",
-		Props: props,
+		TabId:  tabId,
+		Props:  props,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -159,8 +223,8 @@ func (client *TabsClient) Update(tabId int, props *UpdateProperties) error {
 func (client *TabsClient) Move(tabId int, props MoveProperties) error {
 	if response, err := client.Request(&Request{
 		Method: "move",
-		TabId: tabId,
-		Props: &props,
+		TabId:  tabId,
+		Props:  &props,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -172,8 +236,8 @@ func (client *TabsClient) Move(tabId int, props MoveProperties) error {
 func (client *TabsClient) Reload(tabId int, props *ReloadProperties) error {
 	if response, err := client.Request(&Request{
 		Method: "reload",
-		TabId: tabId,
-		Props: &props,
+		TabId:  tabId,
+		Props:  &props,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -233,7 +297,7 @@ func (client *TabsClient) Show(tabId int, tabIds ...int) error {
 func (client *TabsClient) ToggleReaderMode(tabId int) error {
 	if response, err := client.Request(&Request{
 		Method: "toggleReaderMode",
-		TabId: tabId,
+		TabId:  tabId,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -245,7 +309,7 @@ func (client *TabsClient) ToggleReaderMode(tabId int) error {
 func (client *TabsClient) GoBack(tabId int) error {
 	if response, err := client.Request(&Request{
 		Method: "goBack",
-		TabId: tabId,
+		TabId:  tabId,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -257,7 +321,7 @@ func (client *TabsClient) GoBack(tabId int) error {
 func (client *TabsClient) GoForward(tabId int) error {
 	if response, err := client.Request(&Request{
 		Method: "goForward",
-		TabId: tabId,
+		TabId:  tabId,
 	}); err != nil {
 		return err
 	} else if response.Status != "success" {
@@ -266,44 +330,144 @@ func (client *TabsClient) GoForward(tabId int) error {
 	return nil
 }
 
-func (client *TabsClient) Request(msg *Request) (*Response, error) {
-	if client.gatewayConn == nil {
-		return nil, errors.New("Cannot send request to closed gateway connection")
+func (client *TabsClient) Capture(ctx context.Context, tabId int, opts *ImageDetails) (*Capture, error) {
+	response, err := client.RequestContext(ctx, &Request{
+		Method: "captureTab",
+		TabId:  tabId,
+		Props:  opts,
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var capture Capture
+	if err := json.Unmarshal(response.Info, &capture); err != nil {
+		return nil, err
+	}
+	if capture.Data, capture.Format, err = decodeDataUrl(capture.DataUrl); err != nil {
+		return nil, err
+	}
+	return &capture, nil
+}
+
+// runs the script in the tab and returns the result from each frame
+func (client *TabsClient) ExecuteScript(ctx context.Context, tabId int, details InjectDetails) ([]json.RawMessage, error) {
+	response, err := client.RequestContext(ctx, &Request{
+		Method: "executeScript",
+		TabId:  tabId,
+		Props:  &details,
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var results []json.RawMessage
+	if err := json.Unmarshal(response.Info, &results); err != nil {
+		return nil, err
 	}
+	return results, nil
+}
 
+func (client *TabsClient) InsertCSS(ctx context.Context, tabId int, details InjectDetails) error {
+	if response, err := client.RequestContext(ctx, &Request{
+		Method: "insertCSS",
+		TabId:  tabId,
+		Props:  &details,
+	}); err != nil {
+		return err
+	} else if response.Status != "success" {
+		return fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	return nil
+}
+
+func (client *TabsClient) RemoveCSS(ctx context.Context, tabId int, details InjectDetails) error {
+	if response, err := client.RequestContext(ctx, &Request{
+		Method: "removeCSS",
+		TabId:  tabId,
+		Props:  &details,
+	}); err != nil {
+		return err
+	} else if response.Status != "success" {
+		return fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	return nil
+}
+
+func (client *TabsClient) Request(msg *Request) (*Response, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	return client.RequestContext(ctx, msg)
+}
+
+func (client *TabsClient) RequestContext(ctx context.Context, msg *Request) (*Response, error) {
+	if client.gatewayConn == nil {
+		return nil, errors.New("Cannot send request to closed gateway connection")
+	}
 
-	responseChan := make(chan *Response)
+	// buffered so that a late response never blocks the listener
+	responseChan := make(chan *Response, 1)
 	msg.ID = uuid.New()
+	client.mu.Lock()
 	client.requests[msg.ID] = responseChan
-
-	SendMsg(client.gatewayConn, &Message{Request: msg})
+	err := SendMsg(client.gatewayConn, &Message{Request: msg})
+	client.mu.Unlock()
+	defer func() {
+		client.mu.Lock()
+		delete(client.requests, msg.ID)
+		client.mu.Unlock()
+	}()
+	if err != nil {
+		return nil, err
+	}
 
 	select {
 	case <-ctx.Done():
-		return nil, errors.New("Request timed out after 5 seconds")
+		return nil, fmt.Errorf("Request %s failed: %w", msg.Method, ctx.Err())
 	case response := <-responseChan:
-		delete(client.requests, msg.ID)
+		if response.Status == "denied" {
+			return nil, scopeError(response)
+		}
 		return response, nil
 	}
 }
 
+// switches this connection to the named profile
+// with an empty profile, token is the gateway's own token
+func (client *TabsClient) Authenticate(profile, token string) error {
+	if response, err := client.Request(&Request{
+		Method:  "authenticate",
+		Profile: profile,
+		Token:   token,
+	}); err != nil {
+		return err
+	} else if response.Status != "success" {
+		return fmt.Errorf("Gateway responded: %s: %s", response.Status, string(response.Info))
+	}
+	return nil
+}
+
 func (client *TabsClient) listen() {
 	for {
 		msg, err := ReadMsg(client.gatewayConn)
 		if err == io.EOF {
 			log.Fatalf("Received EOF from gateway")
-		} else if err != nil {
-			log.Printf("ERROR: %#v", err)
+		} else if recoverableMsgError(err) {
+			log.Printf("ERROR: from gateway: %v", err)
 			continue
-
+		} else if err != nil {
+			log.Fatalf("ERROR: lost track of messages from gateway: %v", err)
 		}
 		switch {
 		case msg.Response != nil:
 			response := msg.Response
 			log.Printf("Received response for %s", response.ID)
-			if responseChan, exists := client.requests[response.ID]; exists {
+			client.mu.Lock()
+			responseChan, exists := client.requests[response.ID]
+			client.mu.Unlock()
+			if exists {
 				responseChan <- response
 			} else {
 				log.Printf("Received unexpected msg response: %v", response)
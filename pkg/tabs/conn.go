@@ -0,0 +1,141 @@
+package tabs
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+)
+
+// how many messages may wait for a client before it is dropped as too
+// slow to keep up
+const clientQueueSize = 256
+
+// A client of the gateway, whatever transport it arrived over
+// SendMsg may be called from several goroutines at once
+type clientConn interface {
+	ReadMsg() (*Message, error)
+	SendMsg(msg *Message) error
+	Close() error
+	String() string
+}
+
+// The messages waiting to be sent to a client
+// a goroutine per client drains it, so that a slow client only holds up
+// itself and never the event loop
+type outbox struct {
+	conn   clientConn
+	msgs   chan *Message
+	closed chan struct{}
+	once   sync.Once
+}
+
+func makeOutbox(conn clientConn) *outbox {
+	o := &outbox{
+		conn:   conn,
+		msgs:   make(chan *Message, clientQueueSize),
+		closed: make(chan struct{}),
+	}
+	go o.run()
+	return o
+}
+
+func (o *outbox) run() {
+	for {
+		select {
+		case msg := <-o.msgs:
+			if err := o.conn.SendMsg(msg); err != nil {
+				log.Printf("ERROR: Failed to send msg to %v: %v", o.conn, err)
+			}
+		case <-o.closed:
+			return
+		}
+	}
+}
+
+// queues msg, waiting for room if need be
+// must not be called from the event loop; use offer there
+func (o *outbox) send(msg *Message) {
+	select {
+	case o.msgs <- msg:
+	case <-o.closed:
+	}
+}
+
+// queues msg without waiting; a client with no room has fallen too far
+// behind and is disconnected
+func (o *outbox) offer(msg *Message) {
+	select {
+	case o.msgs <- msg:
+	case <-o.closed:
+	default:
+		log.Printf("ERROR: %v has fallen %d messages behind; disconnecting", o.conn, clientQueueSize)
+		o.close()
+	}
+}
+
+// returns a channel for the response to one request, which is then
+// queued for the client; sending on it never blocks
+func (o *outbox) response() chan *Message {
+	responses := make(chan *Message, 1)
+	go func() {
+		select {
+		case msg := <-responses:
+			o.send(msg)
+		case <-o.closed:
+		}
+	}()
+	return responses
+}
+
+// stops sending and closes the connection, which ends its reader
+func (o *outbox) close() {
+	o.once.Do(func() {
+		close(o.closed)
+		o.conn.Close()
+	})
+}
+
+// A client on a stream socket using the native messaging framing
+type streamConn struct {
+	conn net.Conn
+	// guards writes so that messages are not interleaved
+	mu sync.Mutex
+}
+
+func makeStreamConn(conn net.Conn) *streamConn {
+	return &streamConn{conn: conn}
+}
+
+// requests are forwarded to the browser, so there's no use accepting any
+// larger than it would
+func (c *streamConn) ReadMsg() (*Message, error) {
+	return readMsgLimit(c.conn, MaxBrowserMsgSize)
+}
+
+func (c *streamConn) SendMsg(msg *Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return SendMsg(c.conn, msg)
+}
+
+func (c *streamConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *streamConn) String() string {
+	return fmt.Sprintf("%s %s", c.conn.LocalAddr().Network(), c.conn.RemoteAddr())
+}
+
+// only allows listening on loopback addresses, as nothing served by the
+// gateway is meant to leave the machine
+func listenLoopback(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("refusing to listen on non-loopback address %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
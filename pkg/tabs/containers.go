@@ -0,0 +1,124 @@
+package tabs
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// A contextual identity, which tabs refer to by CookieStoreId
+type Container struct {
+	CookieStoreId string `json:"cookieStoreId"`
+	Name          string `json:"name"`
+	Color         string `json:"color"`
+	ColorCode     string `json:"colorCode"`
+	Icon          string `json:"icon"`
+	IconUrl       string `json:"iconUrl"`
+}
+
+// Creating a container requires all three fields
+// Colors: blue, turquoise, green, yellow, orange, red, pink, purple, toolbar
+// Icons: fingerprint, briefcase, dollar, cart, circle, gift, vacation, food,
+// fruit, pet, tree, chill, fence
+type ContainerProperties struct {
+	Name  *string `json:"name,omitempty"`
+	Color *string `json:"color,omitempty"`
+	Icon  *string `json:"icon,omitempty"`
+}
+
+// Sent when a container is created, updated or removed
+type ContainerMsg struct {
+	// "created", "updated" or "removed"
+	Change    string    `json:"-"`
+	Container Container `json:"contextualIdentity"`
+}
+
+func (msg *ContainerMsg) Name() string {
+	switch msg.Change {
+	case "created":
+		return "containerCreated"
+	case "removed":
+		return "containerRemoved"
+	}
+	return "containerUpdated"
+}
+
+func (msg *ContainerMsg) Apply(store *TabStore) error {
+	if msg.Change == "removed" {
+		delete(store.Containers, msg.Container.CookieStoreId)
+		return nil
+	}
+	container := msg.Container
+	store.Containers[container.CookieStoreId] = &container
+	return nil
+}
+
+// returns the containers, limited to those called name if it is non-empty
+func (client *TabsClient) ListContainers(name string) ([]*Container, error) {
+	var props *ContainerProperties
+	if name != "" {
+		props = &ContainerProperties{Name: &name}
+	}
+	response, err := client.Request(&Request{
+		Method: "listContainers",
+		Props:  props,
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var containers []*Container
+	if err := json.Unmarshal(response.Info, &containers); err != nil {
+		return nil, err
+	}
+	return containers, nil
+}
+
+// returns the CookieStoreId of the container called name
+func (client *TabsClient) ContainerId(name string) (string, error) {
+	containers, err := client.ListContainers(name)
+	if err != nil {
+		return "", err
+	}
+	if len(containers) == 0 {
+		return "", fmt.Errorf("No container named %s", name)
+	}
+	return containers[0].CookieStoreId, nil
+}
+
+func (client *TabsClient) CreateContainer(props ContainerProperties) (*Container, error) {
+	return client.containerRequest(&Request{
+		Method: "createContainer",
+		Props:  &props,
+	})
+}
+
+func (client *TabsClient) UpdateContainer(cookieStoreId string, props ContainerProperties) (*Container, error) {
+	return client.containerRequest(&Request{
+		Method:        "updateContainer",
+		CookieStoreId: cookieStoreId,
+		Props:         &props,
+	})
+}
+
+func (client *TabsClient) RemoveContainer(cookieStoreId string) error {
+	_, err := client.containerRequest(&Request{
+		Method:        "removeContainer",
+		CookieStoreId: cookieStoreId,
+	})
+	return err
+}
+
+func (client *TabsClient) containerRequest(request *Request) (*Container, error) {
+	response, err := client.Request(request)
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var container Container
+	if err := json.Unmarshal(response.Info, &container); err != nil {
+		return nil, err
+	}
+	return &container, nil
+}
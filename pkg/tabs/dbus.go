@@ -0,0 +1,511 @@
+//go:build linux
+
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/google/uuid"
+)
+
+var (
+	// register the gateway on the session bus
+	// only supported on linux, where godbus builds
+	GatewayDBus = false
+)
+
+const (
+	dbusName  = "io.github.erik_overdahl.TabsServer"
+	dbusPath  = dbus.ObjectPath("/io/github/erik_overdahl/TabsServer")
+	dbusIface = "io.github.erik_overdahl.TabsServer"
+	// each audible tab gets its own player, named after the tab
+	mprisNamePrefix  = "org.mpris.MediaPlayer2.tabs_server.tab"
+	mprisPath        = dbus.ObjectPath("/org/mpris/MediaPlayer2")
+	mprisIface       = "org.mpris.MediaPlayer2"
+	mprisPlayerIface = "org.mpris.MediaPlayer2.Player"
+	dbusTimeout      = 5 * time.Second
+)
+
+// A tab as returned by ListTabs, signature (iisssbbb)
+type DBusTab struct {
+	ID       int32
+	WindowId int32
+	Url      string
+	Title    string
+	Status   string
+	Active   bool
+	Audible  bool
+	Muted    bool
+}
+
+// Bridges the session bus to the gateway. It is a gateway client like
+// any other: method calls become requests and events become signals
+// (Event(name, json)), so it goes through the same handling as sockets.
+type dbusConn struct {
+	conn *dbus.Conn
+	// requests from method calls, read by the gateway
+	requests chan *Message
+	closed   chan struct{}
+	// guards pending
+	mu      sync.Mutex
+	pending map[uuid.UUID]chan *Response
+	// nudged when an event may have changed which tabs are playing
+	resync chan struct{}
+	// by tab id; only touched by syncPlayers
+	players map[int]*mprisPlayer
+}
+
+// connects to the session bus and claims the service name
+func startDBus() (*dbusConn, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+	c := &dbusConn{
+		conn:     conn,
+		requests: make(chan *Message),
+		closed:   make(chan struct{}),
+		pending:  make(map[uuid.UUID]chan *Response),
+		resync:   make(chan struct{}, 1),
+		players:  make(map[int]*mprisPlayer),
+	}
+	service := &dbusService{c}
+	if err := conn.Export(service, dbusPath, dbusIface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	node := &introspect.Node{
+		Name: string(dbusPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			{
+				Name:    dbusIface,
+				Methods: introspect.Methods(service),
+				Signals: []introspect.Signal{{
+					Name: "Event",
+					Args: []introspect.Arg{
+						{Name: "name", Type: "s"},
+						{Name: "data", Type: "s"},
+					},
+				}},
+			},
+		},
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), dbusPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reply, err := conn.RequestName(dbusName, dbus.NameFlagDoNotQueue)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("D-Bus name %s is already taken", dbusName)
+	}
+	go c.syncPlayers()
+	c.resync <- struct{}{}
+	return c, nil
+}
+
+func (c *dbusConn) ReadMsg() (*Message, error) {
+	select {
+	case msg := <-c.requests:
+		return msg, nil
+	case <-c.closed:
+		return nil, io.EOF
+	}
+}
+
+func (c *dbusConn) SendMsg(msg *Message) error {
+	switch {
+	case msg.Response != nil:
+		c.mu.Lock()
+		responses, exists := c.pending[msg.Response.ID]
+		delete(c.pending, msg.Response.ID)
+		c.mu.Unlock()
+		if exists {
+			responses <- msg.Response
+		}
+	case msg.Event != nil:
+		data, err := json.Marshal(msg.Event)
+		if err != nil {
+			return err
+		}
+		if playerEvent(msg.Event) {
+			select {
+			case c.resync <- struct{}{}:
+			default:
+			}
+		}
+		return c.conn.Emit(dbusPath, dbusIface+".Event", msg.Event.Name(), string(data))
+	}
+	return nil
+}
+
+func (c *dbusConn) Close() error {
+	select {
+	case <-c.closed:
+	default:
+		close(c.closed)
+	}
+	return c.conn.Close()
+}
+
+func (c *dbusConn) String() string {
+	return "dbus " + dbusName
+}
+
+// sends the request through the gateway and waits for the response
+func (c *dbusConn) request(request *Request) (*Response, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbusTimeout)
+	defer cancel()
+	request.ID = uuid.New()
+	responses := make(chan *Response, 1)
+	c.mu.Lock()
+	c.pending[request.ID] = responses
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, request.ID)
+		c.mu.Unlock()
+	}()
+	select {
+	case c.requests <- &Message{Request: request}:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Request %s failed: %w", request.Method, ctx.Err())
+	}
+	select {
+	case response := <-responses:
+		if response.Status == "denied" {
+			return nil, scopeError(response)
+		}
+		if response.Status == "error" {
+			return nil, fmt.Errorf("%s failed: %s", request.Method, string(response.Info))
+		}
+		return response, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Request %s failed: %w", request.Method, ctx.Err())
+	}
+}
+
+func (c *dbusConn) listTabs() ([]*Tab, error) {
+	response, err := c.request(&Request{Method: "list"})
+	if err != nil {
+		return nil, err
+	}
+	var tabs []*Tab
+	if err := json.Unmarshal(response.Info, &tabs); err != nil {
+		return nil, err
+	}
+	return tabs, nil
+}
+
+func (c *dbusConn) setMuted(tabId int, muted bool) error {
+	_, err := c.request(&Request{Method: "update", TabId: tabId, Props: &UpdateProperties{Muted: &muted}})
+	return err
+}
+
+func (c *dbusConn) activate(tabId int) error {
+	_, err := c.request(&Request{Method: "update", TabId: tabId, Props: &UpdateProperties{Active: ptr(true)}})
+	return err
+}
+
+// whether the event may start, stop or change a player
+func playerEvent(event Event) bool {
+	switch e := event.(type) {
+	case *UpdatedMsg:
+		return e.Delta.Audible != nil || e.Delta.MutedInfo != nil || e.Delta.Title != nil || e.Delta.Url != nil
+	case *RemovedMsg:
+		return true
+	}
+	return false
+}
+
+// keeps one player per audible tab, until the connection closes
+func (c *dbusConn) syncPlayers() {
+	for {
+		select {
+		case <-c.closed:
+			for _, player := range c.players {
+				player.close()
+			}
+			return
+		case <-c.resync:
+		}
+		tabs, err := c.listTabs()
+		if err != nil {
+			log.Printf("ERROR: D-Bus: listing tabs for media players: %v", err)
+			continue
+		}
+		audible := make(map[int]*Tab)
+		for _, tab := range tabs {
+			if tab.Audible && !tab.Incognito {
+				audible[tab.ID] = tab
+			}
+		}
+		for tabId, player := range c.players {
+			if _, exists := audible[tabId]; !exists {
+				player.close()
+				delete(c.players, tabId)
+			}
+		}
+		for tabId, tab := range audible {
+			if player, exists := c.players[tabId]; exists {
+				player.update(tab)
+				continue
+			}
+			player, err := startMprisPlayer(c, tab)
+			if err != nil {
+				log.Printf("ERROR: D-Bus: media player for tab %d: %v", tabId, err)
+				continue
+			}
+			c.players[tabId] = player
+		}
+	}
+}
+
+// The methods of the gateway's D-Bus interface
+type dbusService struct {
+	c *dbusConn
+}
+
+func dbusError(err error) *dbus.Error {
+	return dbus.NewError(dbusIface+".Error", []interface{}{err.Error()})
+}
+
+func (s *dbusService) ListTabs() ([]DBusTab, *dbus.Error) {
+	tabs, err := s.c.listTabs()
+	if err != nil {
+		return nil, dbusError(err)
+	}
+	list := make([]DBusTab, 0, len(tabs))
+	for _, tab := range tabs {
+		list = append(list, DBusTab{
+			ID:       int32(tab.ID),
+			WindowId: int32(tab.WindowId),
+			Url:      tab.Url,
+			Title:    tab.Title,
+			Status:   tab.Status,
+			Active:   tab.Active,
+			Audible:  tab.Audible,
+			Muted:    tab.MutedInfo != nil && tab.MutedInfo.Muted,
+		})
+	}
+	return list, nil
+}
+
+func (s *dbusService) Activate(tabId int32) *dbus.Error {
+	if err := s.c.activate(int(tabId)); err != nil {
+		return dbusError(err)
+	}
+	return nil
+}
+
+func (s *dbusService) Close(tabId int32) *dbus.Error {
+	if _, err := s.c.request(&Request{Method: "remove", TabIds: []int{int(tabId)}}); err != nil {
+		return dbusError(err)
+	}
+	return nil
+}
+
+func (s *dbusService) Create(url string) (int32, *dbus.Error) {
+	response, err := s.c.request(&Request{Method: "create", Props: &CreateProperties{Url: &url}})
+	if err != nil {
+		return -1, dbusError(err)
+	}
+	var tabId int32
+	if err := json.Unmarshal(response.Info, &tabId); err != nil {
+		return -1, dbusError(err)
+	}
+	return tabId, nil
+}
+
+// An MPRIS player for one audible tab, on its own bus connection since
+// every player must live at the same object path. Pausing mutes the tab.
+type mprisPlayer struct {
+	c     *dbusConn
+	tabId int
+	conn  *dbus.Conn
+	props *prop.Properties
+}
+
+func startMprisPlayer(c *dbusConn, tab *Tab) (*mprisPlayer, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, err
+	}
+	player := &mprisPlayer{c: c, tabId: tab.ID, conn: conn}
+	root := &mprisRoot{player}
+	controls := &mprisControls{player}
+	props, err := prop.Export(conn, mprisPath, prop.Map{
+		mprisIface: {
+			"CanQuit":             {Value: false, Emit: prop.EmitFalse},
+			"CanRaise":            {Value: true, Emit: prop.EmitFalse},
+			"HasTrackList":        {Value: false, Emit: prop.EmitFalse},
+			"Identity":            {Value: fmt.Sprintf("Browser tab %d", tab.ID), Emit: prop.EmitFalse},
+			"SupportedUriSchemes": {Value: []string{}, Emit: prop.EmitFalse},
+			"SupportedMimeTypes":  {Value: []string{}, Emit: prop.EmitFalse},
+		},
+		mprisPlayerIface: {
+			"PlaybackStatus": {Value: playbackStatus(tab), Emit: prop.EmitTrue},
+			"Metadata":       {Value: mprisMetadata(tab), Emit: prop.EmitTrue},
+			"Rate":           {Value: 1.0, Emit: prop.EmitFalse},
+			"MinimumRate":    {Value: 1.0, Emit: prop.EmitFalse},
+			"MaximumRate":    {Value: 1.0, Emit: prop.EmitFalse},
+			"Volume":         {Value: 1.0, Emit: prop.EmitFalse},
+			"Position":       {Value: int64(0), Emit: prop.EmitFalse},
+			"CanGoNext":      {Value: false, Emit: prop.EmitFalse},
+			"CanGoPrevious":  {Value: false, Emit: prop.EmitFalse},
+			"CanPlay":        {Value: true, Emit: prop.EmitFalse},
+			"CanPause":       {Value: true, Emit: prop.EmitFalse},
+			"CanSeek":        {Value: false, Emit: prop.EmitFalse},
+			"CanControl":     {Value: true, Emit: prop.EmitFalse},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	player.props = props
+	if err := conn.Export(root, mprisPath, mprisIface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	controlNames := map[string]string{"SeekBy": "Seek"}
+	if err := conn.ExportWithMap(controls, controlNames, mprisPath, mprisPlayerIface); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	controlMethods := introspect.Methods(controls)
+	for i, method := range controlMethods {
+		if name, exists := controlNames[method.Name]; exists {
+			controlMethods[i].Name = name
+		}
+	}
+	node := &introspect.Node{
+		Name: string(mprisPath),
+		Interfaces: []introspect.Interface{
+			introspect.IntrospectData,
+			prop.IntrospectData,
+			{Name: mprisIface, Methods: introspect.Methods(root), Properties: props.Introspection(mprisIface)},
+			{Name: mprisPlayerIface, Methods: controlMethods, Properties: props.Introspection(mprisPlayerIface)},
+		},
+	}
+	if err := conn.Export(introspect.NewIntrospectable(node), mprisPath, "org.freedesktop.DBus.Introspectable"); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	name := fmt.Sprintf("%s%d", mprisNamePrefix, tab.ID)
+	if reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue); err != nil {
+		conn.Close()
+		return nil, err
+	} else if reply != dbus.RequestNameReplyPrimaryOwner {
+		conn.Close()
+		return nil, fmt.Errorf("D-Bus name %s is already taken", name)
+	}
+	return player, nil
+}
+
+func (p *mprisPlayer) update(tab *Tab) {
+	p.props.SetMust(mprisPlayerIface, "PlaybackStatus", playbackStatus(tab))
+	p.props.SetMust(mprisPlayerIface, "Metadata", mprisMetadata(tab))
+}
+
+func (p *mprisPlayer) close() {
+	p.conn.Close()
+}
+
+func (p *mprisPlayer) setMuted(muted bool) *dbus.Error {
+	if err := p.c.setMuted(p.tabId, muted); err != nil {
+		return dbusError(err)
+	}
+	return nil
+}
+
+// a muted tab is as good as paused to whoever is listening
+func playbackStatus(tab *Tab) string {
+	if tab.MutedInfo != nil && tab.MutedInfo.Muted {
+		return "Paused"
+	}
+	return "Playing"
+}
+
+func mprisMetadata(tab *Tab) map[string]dbus.Variant {
+	return map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(dbus.ObjectPath(fmt.Sprintf("/io/github/erik_overdahl/TabsServer/tab/%d", tab.ID))),
+		"xesam:title":   dbus.MakeVariant(tab.Title),
+		"xesam:url":     dbus.MakeVariant(tab.Url),
+	}
+}
+
+// org.mpris.MediaPlayer2
+type mprisRoot struct {
+	p *mprisPlayer
+}
+
+func (r *mprisRoot) Raise() *dbus.Error {
+	if err := r.p.c.activate(r.p.tabId); err != nil {
+		return dbusError(err)
+	}
+	return nil
+}
+
+func (r *mprisRoot) Quit() *dbus.Error {
+	return nil
+}
+
+// org.mpris.MediaPlayer2.Player
+type mprisControls struct {
+	p *mprisPlayer
+}
+
+func (m *mprisControls) Play() *dbus.Error {
+	return m.p.setMuted(false)
+}
+
+func (m *mprisControls) Pause() *dbus.Error {
+	return m.p.setMuted(true)
+}
+
+func (m *mprisControls) Stop() *dbus.Error {
+	return m.p.setMuted(true)
+}
+
+func (m *mprisControls) PlayPause() *dbus.Error {
+	status, err := m.p.props.Get(mprisPlayerIface, "PlaybackStatus")
+	if err != nil {
+		return err
+	}
+	return m.p.setMuted(status.Value() == "Playing")
+}
+
+func (m *mprisControls) Next() *dbus.Error {
+	return nil
+}
+
+func (m *mprisControls) Previous() *dbus.Error {
+	return nil
+}
+
+// exported as Seek; go vet expects a method called Seek to be io.Seeker's
+func (m *mprisControls) SeekBy(offset int64) *dbus.Error {
+	return nil
+}
+
+func (m *mprisControls) SetPosition(trackId dbus.ObjectPath, position int64) *dbus.Error {
+	return nil
+}
+
+func (m *mprisControls) OpenUri(uri string) *dbus.Error {
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package tabs
+
+import "errors"
+
+var (
+	// register the gateway on the session bus
+	// only supported on linux, where godbus builds
+	GatewayDBus = false
+)
+
+func startDBus() (clientConn, error) {
+	return nil, errors.New("D-Bus is only supported on linux")
+}
@@ -0,0 +1,176 @@
+//go:build linux
+
+package tabs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// starts a private session bus and points the session bus address at it
+func startTestBus(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("dbus-daemon"); err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+	cmd := exec.Command("dbus-daemon", "--session", "--print-address", "--nofork")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading bus address: %v", err)
+	}
+	t.Setenv("DBUS_SESSION_BUS_ADDRESS", strings.TrimSpace(addr))
+}
+
+// Answers requests from a dbusConn the way the gateway would, recording them
+type fakeGateway struct {
+	conn     *dbusConn
+	tabs     []*Tab
+	requests chan *Request
+}
+
+func (g *fakeGateway) serve() {
+	for {
+		msg, err := g.conn.ReadMsg()
+		if err != nil {
+			return
+		}
+		request := msg.Request
+		var info []byte
+		switch request.Method {
+		case "list":
+			info, _ = json.Marshal(g.tabs)
+		default:
+			g.requests <- request
+		}
+		g.conn.SendMsg(&Message{Response: &Response{ID: request.ID, Status: "success", Info: info}})
+	}
+}
+
+func (g *fakeGateway) expect(t *testing.T, method string) *Request {
+	t.Helper()
+	select {
+	case request := <-g.requests:
+		if request.Method != method {
+			t.Fatalf("gateway got %s, want %s", request.Method, method)
+		}
+		return request
+	case <-time.After(dbusTimeout):
+		t.Fatalf("gateway never got %s", method)
+		return nil
+	}
+}
+
+func startTestDBus(t *testing.T, tabs []*Tab) (*fakeGateway, *dbus.Conn) {
+	t.Helper()
+	startTestBus(t)
+	conn, err := startDBus()
+	if err != nil {
+		t.Fatalf("startDBus: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	gateway := &fakeGateway{conn: conn, tabs: tabs, requests: make(chan *Request, 10)}
+	go gateway.serve()
+	client, err := dbus.ConnectSessionBus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return gateway, client
+}
+
+func TestDBusListTabs(t *testing.T) {
+	_, client := startTestDBus(t, []*Tab{
+		{ID: 3, WindowId: 1, Url: "https://example.com/", Title: "Example", Status: "complete", Active: true},
+	})
+	var tabs []DBusTab
+	if err := client.Object(dbusName, dbusPath).Call(dbusIface+".ListTabs", 0).Store(&tabs); err != nil {
+		t.Fatal(err)
+	}
+	want := DBusTab{ID: 3, WindowId: 1, Url: "https://example.com/", Title: "Example", Status: "complete", Active: true}
+	if len(tabs) != 1 || tabs[0] != want {
+		t.Fatalf("ListTabs = %+v, want [%+v]", tabs, want)
+	}
+}
+
+func TestDBusClose(t *testing.T) {
+	gateway, client := startTestDBus(t, nil)
+	if err := client.Object(dbusName, dbusPath).Call(dbusIface+".Close", 0, int32(7)).Err; err != nil {
+		t.Fatal(err)
+	}
+	request := gateway.expect(t, "remove")
+	if len(request.TabIds) != 1 || request.TabIds[0] != 7 {
+		t.Fatalf("remove got tab ids %v, want [7]", request.TabIds)
+	}
+}
+
+func TestDBusEventSignal(t *testing.T) {
+	gateway, client := startTestDBus(t, nil)
+	if err := client.AddMatchSignal(dbus.WithMatchInterface(dbusIface), dbus.WithMatchMember("Event")); err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan *dbus.Signal, 10)
+	client.Signal(signals)
+	if err := gateway.conn.SendMsg(&Message{Event: &RemovedMsg{TabId: 5, WindowId: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case signal := <-signals:
+		if len(signal.Body) != 2 || signal.Body[0] != "removed" {
+			t.Fatalf("got signal %v, want a removed event", signal.Body)
+		}
+		var event RemovedMsg
+		if err := json.Unmarshal([]byte(signal.Body[1].(string)), &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.TabId != 5 {
+			t.Fatalf("signal is for tab %d, want 5", event.TabId)
+		}
+	case <-time.After(dbusTimeout):
+		t.Fatal("no Event signal")
+	}
+}
+
+func TestMprisPlayPauseMutes(t *testing.T) {
+	gateway, client := startTestDBus(t, []*Tab{
+		{ID: 9, WindowId: 1, Url: "https://example.com/song", Title: "Song", Audible: true},
+	})
+	name := fmt.Sprintf("%s%d", mprisNamePrefix, 9)
+	player := client.Object(name, mprisPath)
+	// the player appears once syncPlayers has listed the tabs
+	deadline := time.Now().Add(dbusTimeout)
+	for {
+		err := player.Call(mprisPlayerIface+".PlayPause", 0).Err
+		if err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("PlayPause: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	request := gateway.expect(t, "update")
+	props, ok := request.Props.(*UpdateProperties)
+	if !ok || props.Muted == nil || !*props.Muted {
+		t.Fatalf("PlayPause on a playing tab sent %#v, want muted", request.Props)
+	}
+	if request.TabId != 9 {
+		t.Fatalf("PlayPause updated tab %d, want 9", request.TabId)
+	}
+}
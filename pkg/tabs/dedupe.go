@@ -0,0 +1,113 @@
+package tabs
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// query parameters that only exist to track where a visit came from
+var TrackingParams = []string{
+	"fbclid", "gclid", "dclid", "msclkid", "mc_cid", "mc_eid", "igshid", "_ga", "_gl", "yclid",
+}
+
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	if strings.HasPrefix(key, "utm_") {
+		return true
+	}
+	for _, param := range TrackingParams {
+		if key == param {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a canonical form of rawUrl so that equivalent urls compare equal
+// the fragment, tracking parameters and trailing slashes are dropped,
+// the scheme and host are lowercased and the query is sorted
+func NormalizeUrl(rawUrl string) string {
+	u, err := url.Parse(rawUrl)
+	if err != nil || u.Opaque != "" {
+		return rawUrl
+	}
+	u.Fragment = ""
+	u.RawFragment = ""
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) ||
+		(u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	u.Path = strings.TrimRight(u.Path, "/")
+	u.RawPath = ""
+	query := u.Query()
+	for key := range query {
+		if isTrackingParam(key) {
+			query.Del(key)
+		}
+	}
+	// Encode sorts by key
+	u.RawQuery = query.Encode()
+	u.ForceQuery = false
+	return u.String()
+}
+
+// returns groups of open tabs with equivalent urls in the same container
+// within each group the most recently accessed tab comes first
+func (s *TabStore) Duplicates() [][]*Tab {
+	byUrl := make(map[string][]*Tab)
+	for _, tab := range s.Open {
+		key := tab.CookieStoreId + " " + NormalizeUrl(tab.Url)
+		byUrl[key] = append(byUrl[key], tab)
+	}
+	groups := [][]*Tab{}
+	for _, tabs := range byUrl {
+		if len(tabs) < 2 {
+			continue
+		}
+		sort.Slice(tabs, func(i, j int) bool {
+			if tabs[i].LastAccessed != tabs[j].LastAccessed {
+				return tabs[i].LastAccessed > tabs[j].LastAccessed
+			}
+			return tabs[i].ID < tabs[j].ID
+		})
+		groups = append(groups, tabs)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return NormalizeUrl(groups[i][0].Url) < NormalizeUrl(groups[j][0].Url)
+	})
+	return groups
+}
+
+// returns the tabs Dedupe would close: all but the most recently accessed
+// tab of each group, never closing pinned tabs
+func DuplicatesToClose(groups [][]*Tab) []*Tab {
+	toClose := []*Tab{}
+	for _, group := range groups {
+		for _, tab := range group[1:] {
+			if !tab.Pinned {
+				toClose = append(toClose, tab)
+			}
+		}
+	}
+	return toClose
+}
+
+// closes duplicate tabs, keeping the most recently accessed of each group
+// returns the tabs closed
+func (client *TabsClient) Dedupe(store *TabStore) ([]*Tab, error) {
+	toClose := DuplicatesToClose(store.Duplicates())
+	if len(toClose) == 0 {
+		return toClose, nil
+	}
+	ids := make([]int, len(toClose))
+	for i, tab := range toClose {
+		ids[i] = tab.ID
+	}
+	if err := client.Close(ids[0], ids[1:]...); err != nil {
+		return nil, err
+	}
+	return toClose, nil
+}
@@ -0,0 +1,234 @@
+package tabs
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestNormalizeUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		// fragments
+		{"https://example.com/page#section", "https://example.com/page"},
+		{"https://example.com/page#", "https://example.com/page"},
+		// tracking parameters
+		{"https://example.com/?utm_source=feed&utm_medium=rss&UTM_Campaign=x", "https://example.com"},
+		{"https://example.com/a?id=3&utm_source=feed", "https://example.com/a?id=3"},
+		{"https://example.com/a?fbclid=abc&gclid=def&q=go", "https://example.com/a?q=go"},
+		// only the utm_ prefix, not anything containing it
+		{"https://example.com/a?notutm_source=1", "https://example.com/a?notutm_source=1"},
+		// default ports
+		{"http://example.com:80/a", "http://example.com/a"},
+		{"https://example.com:443/a", "https://example.com/a"},
+		{"https://example.com:80/a", "https://example.com:80/a"},
+		{"http://example.com:8080/a", "http://example.com:8080/a"},
+		// trailing slashes
+		{"https://example.com/a/", "https://example.com/a"},
+		{"https://example.com/a//", "https://example.com/a"},
+		{"https://example.com/", "https://example.com"},
+		// query ordering
+		{"https://example.com/s?b=2&a=1", "https://example.com/s?a=1&b=2"},
+		{"https://example.com/s?", "https://example.com/s"},
+		// case of the scheme and host, but not the path
+		{"HTTPS://Example.COM/Path", "https://example.com/Path"},
+		// left alone
+		{"about:blank", "about:blank"},
+		{"http://[::1", "http://[::1"},
+	}
+	for _, test := range tests {
+		if got := NormalizeUrl(test.url); got != test.want {
+			t.Errorf("NormalizeUrl(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+}
+
+func TestNormalizeUrlEquivalents(t *testing.T) {
+	urls := []string{
+		"https://example.com/article?id=7&page=2",
+		"https://example.com/article/?page=2&id=7",
+		"https://EXAMPLE.com:443/article?page=2&id=7#comments",
+		"https://example.com/article?utm_source=hn&id=7&page=2&fbclid=x",
+	}
+	want := NormalizeUrl(urls[0])
+	for _, url := range urls[1:] {
+		if got := NormalizeUrl(url); got != want {
+			t.Errorf("NormalizeUrl(%q) = %q, want %q", url, got, want)
+		}
+	}
+}
+
+func storeOf(tabs ...*Tab) *TabStore {
+	store := MakeTabStore()
+	for _, tab := range tabs {
+		store.Open[tab.ID] = tab
+	}
+	return store
+}
+
+func tabIds(tabs []*Tab) []int {
+	ids := make([]int, len(tabs))
+	for i, tab := range tabs {
+		ids[i] = tab.ID
+	}
+	return ids
+}
+
+func groupIds(groups [][]*Tab) [][]int {
+	ids := make([][]int, len(groups))
+	for i, group := range groups {
+		ids[i] = tabIds(group)
+	}
+	return ids
+}
+
+func TestDuplicates(t *testing.T) {
+	tests := []struct {
+		name   string
+		tabs   []*Tab
+		groups [][]int
+		close  []int
+	}{
+		{
+			name: "most recently accessed wins",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://example.com/a", LastAccessed: 100},
+				{ID: 2, Url: "https://example.com/a#top", LastAccessed: 300},
+				{ID: 3, Url: "https://example.com/a/?utm_source=x", LastAccessed: 200},
+			},
+			groups: [][]int{{2, 3, 1}},
+			close:  []int{3, 1},
+		},
+		{
+			name: "ties go to the lowest id",
+			tabs: []*Tab{
+				{ID: 5, Url: "https://example.com/", LastAccessed: 100},
+				{ID: 4, Url: "https://example.com", LastAccessed: 100},
+			},
+			groups: [][]int{{4, 5}},
+			close:  []int{5},
+		},
+		{
+			name: "pinned tabs are kept",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://example.com/", LastAccessed: 100, Pinned: true},
+				{ID: 2, Url: "https://example.com/", LastAccessed: 300},
+				{ID: 3, Url: "https://example.com/", LastAccessed: 200},
+			},
+			groups: [][]int{{2, 3, 1}},
+			close:  []int{3},
+		},
+		{
+			name: "all pinned",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://example.com/", LastAccessed: 100, Pinned: true},
+				{ID: 2, Url: "https://example.com/", LastAccessed: 200, Pinned: true},
+			},
+			groups: [][]int{{2, 1}},
+			close:  []int{},
+		},
+		{
+			name: "containers are kept apart",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://mail.example.com/", CookieStoreId: "firefox-default", LastAccessed: 100},
+				{ID: 2, Url: "https://mail.example.com/", CookieStoreId: "firefox-container-1", LastAccessed: 200},
+				{ID: 3, Url: "https://mail.example.com/", CookieStoreId: "firefox-container-1", LastAccessed: 300},
+			},
+			groups: [][]int{{3, 2}},
+			close:  []int{2},
+		},
+		{
+			name: "different queries are different pages",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://example.com/s?q=go"},
+				{ID: 2, Url: "https://example.com/s?q=rust"},
+				{ID: 3, Url: "http://example.com/s?q=go"},
+			},
+			groups: [][]int{},
+			close:  []int{},
+		},
+		{
+			name: "groups are sorted by url",
+			tabs: []*Tab{
+				{ID: 1, Url: "https://b.example.com/", LastAccessed: 1},
+				{ID: 2, Url: "https://b.example.com/", LastAccessed: 2},
+				{ID: 3, Url: "https://a.example.com/?b=2&a=1", LastAccessed: 3},
+				{ID: 4, Url: "https://a.example.com/?a=1&b=2", LastAccessed: 4},
+			},
+			groups: [][]int{{4, 3}, {2, 1}},
+			close:  []int{3, 1},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			groups := storeOf(test.tabs...).Duplicates()
+			if got := groupIds(groups); !reflect.DeepEqual(got, test.groups) {
+				t.Fatalf("Duplicates() = %v, want %v", got, test.groups)
+			}
+			if got := tabIds(DuplicatesToClose(groups)); !reflect.DeepEqual(got, test.close) {
+				t.Fatalf("DuplicatesToClose() = %v, want %v", got, test.close)
+			}
+		})
+	}
+}
+
+// answers the requests a client sends on conn with success, passing them on
+func serveRequests(conn net.Conn) <-chan *Request {
+	requests := make(chan *Request, 10)
+	go func() {
+		for {
+			msg, err := ReadMsg(conn)
+			if err != nil {
+				return
+			}
+			requests <- msg.Request
+			if err := SendMsg(conn, &Message{Response: &Response{ID: msg.Request.ID, Status: "success"}}); err != nil {
+				return
+			}
+		}
+	}()
+	return requests
+}
+
+func TestDedupe(t *testing.T) {
+	// left open: the client exits when it loses the gateway
+	clientEnd, gatewayEnd := net.Pipe()
+	client := MakeTabsClient()
+	client.gatewayConn = clientEnd
+	go client.listen()
+	requests := serveRequests(gatewayEnd)
+
+	store := storeOf(
+		&Tab{ID: 1, Url: "https://example.com/", LastAccessed: 100},
+		&Tab{ID: 2, Url: "https://example.com/#x", LastAccessed: 300},
+		&Tab{ID: 3, Url: "https://example.com/?utm_medium=email", LastAccessed: 200, Pinned: true},
+		&Tab{ID: 4, Url: "https://example.com/", CookieStoreId: "firefox-container-2", LastAccessed: 50},
+		&Tab{ID: 5, Url: "https://go.dev/", LastAccessed: 10},
+	)
+	closed, err := client.Dedupe(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tabIds(closed); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("Dedupe closed %v, want [1]", got)
+	}
+	request := <-requests
+	sort.Ints(request.TabIds)
+	if request.Method != "remove" || !reflect.DeepEqual(request.TabIds, []int{1}) {
+		t.Fatalf("Dedupe sent %s %v, want remove [1]", request.Method, request.TabIds)
+	}
+
+	// with nothing to close, nothing is sent
+	closed, err = client.Dedupe(storeOf(&Tab{ID: 5, Url: "https://go.dev/"}))
+	if err != nil || len(closed) != 0 {
+		t.Fatalf("Dedupe = %v, %v, want nothing closed", tabIds(closed), err)
+	}
+	select {
+	case request := <-requests:
+		t.Fatalf("Dedupe sent %s with nothing to close", request.Method)
+	default:
+	}
+}
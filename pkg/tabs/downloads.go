@@ -0,0 +1,334 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+type DownloadItem struct {
+	ID       int    `json:"id"`
+	Url      string `json:"url"`
+	Filename string `json:"filename"`
+	Mime     string `json:"mime"`
+	// "in_progress", "interrupted" or "complete"
+	State         string `json:"state"`
+	Paused        bool   `json:"paused"`
+	CanResume     bool   `json:"canResume"`
+	Error         string `json:"error,omitempty"`
+	Danger        string `json:"danger"`
+	BytesReceived int64  `json:"bytesReceived"`
+	// -1 if unknown
+	TotalBytes    int64  `json:"totalBytes"`
+	FileSize      int64  `json:"fileSize"`
+	Exists        bool   `json:"exists"`
+	StartTime     string `json:"startTime"`
+	EndTime       string `json:"endTime,omitempty"`
+	Incognito     bool   `json:"incognito"`
+	CookieStoreId string `json:"cookieStoreId,omitempty"`
+}
+
+type DownloadHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type DownloadOptions struct {
+	Url      string  `json:"url"`
+	Filename *string `json:"filename,omitempty"`
+	SaveAs   *bool   `json:"saveAs,omitempty"`
+	// "uniquify", "overwrite" or "prompt"
+	ConflictAction *string          `json:"conflictAction,omitempty"`
+	Method         *string          `json:"method,omitempty"`
+	Headers        []DownloadHeader `json:"headers,omitempty"`
+	Body           *string          `json:"body,omitempty"`
+	Incognito      *bool            `json:"incognito,omitempty"`
+	CookieStoreId  *string          `json:"cookieStoreId,omitempty"`
+}
+
+type DownloadQuery struct {
+	ID    *int    `json:"id,omitempty"`
+	Url   *string `json:"url,omitempty"`
+	State *string `json:"state,omitempty"`
+	Limit *int    `json:"limit,omitempty"`
+	// e.g. ["-startTime"]
+	OrderBy []string `json:"orderBy,omitempty"`
+}
+
+type Change[T any] struct {
+	Previous T `json:"previous"`
+	Current  T `json:"current"`
+}
+
+// The fields of a download that changed; unchanged fields are nil
+type DownloadDelta struct {
+	ID         int             `json:"id"`
+	Url        *Change[string] `json:"url,omitempty"`
+	Filename   *Change[string] `json:"filename,omitempty"`
+	Mime       *Change[string] `json:"mime,omitempty"`
+	State      *Change[string] `json:"state,omitempty"`
+	Paused     *Change[bool]   `json:"paused,omitempty"`
+	CanResume  *Change[bool]   `json:"canResume,omitempty"`
+	Error      *Change[string] `json:"error,omitempty"`
+	Danger     *Change[string] `json:"danger,omitempty"`
+	TotalBytes *Change[int64]  `json:"totalBytes,omitempty"`
+	FileSize   *Change[int64]  `json:"fileSize,omitempty"`
+	Exists     *Change[bool]   `json:"exists,omitempty"`
+	EndTime    *Change[string] `json:"endTime,omitempty"`
+}
+
+// Events
+
+type DownloadCreatedMsg DownloadItem
+
+func (_ *DownloadCreatedMsg) Name() string {
+	return "downloadCreated"
+}
+
+func (msg *DownloadCreatedMsg) Apply(store *TabStore) error {
+	item := DownloadItem(*msg)
+	store.Downloads[item.ID] = &item
+	return nil
+}
+
+type DownloadChangedMsg DownloadDelta
+
+func (_ *DownloadChangedMsg) Name() string {
+	return "downloadChanged"
+}
+
+func (msg *DownloadChangedMsg) Apply(store *TabStore) error {
+	item, exists := store.Downloads[msg.ID]
+	if !exists {
+		return fmt.Errorf("ERROR: DownloadChanged: Download with id %d not found", msg.ID)
+	}
+	if msg.Url != nil {
+		item.Url = msg.Url.Current
+	}
+	if msg.Filename != nil {
+		item.Filename = msg.Filename.Current
+	}
+	if msg.Mime != nil {
+		item.Mime = msg.Mime.Current
+	}
+	if msg.State != nil {
+		item.State = msg.State.Current
+	}
+	if msg.Paused != nil {
+		item.Paused = msg.Paused.Current
+	}
+	if msg.CanResume != nil {
+		item.CanResume = msg.CanResume.Current
+	}
+	if msg.Error != nil {
+		item.Error = msg.Error.Current
+	}
+	if msg.Danger != nil {
+		item.Danger = msg.Danger.Current
+	}
+	if msg.TotalBytes != nil {
+		item.TotalBytes = msg.TotalBytes.Current
+	}
+	if msg.FileSize != nil {
+		item.FileSize = msg.FileSize.Current
+	}
+	if msg.Exists != nil {
+		item.Exists = msg.Exists.Current
+	}
+	if msg.EndTime != nil {
+		item.EndTime = msg.EndTime.Current
+	}
+	return nil
+}
+
+// The browser does not report progress as a change, so the extension
+// polls in-progress downloads and sends this
+type DownloadProgressMsg struct {
+	ID            int   `json:"id"`
+	BytesReceived int64 `json:"bytesReceived"`
+	TotalBytes    int64 `json:"totalBytes"`
+}
+
+func (_ *DownloadProgressMsg) Name() string {
+	return "downloadProgress"
+}
+
+func (msg *DownloadProgressMsg) Apply(store *TabStore) error {
+	item, exists := store.Downloads[msg.ID]
+	if !exists {
+		return fmt.Errorf("ERROR: DownloadProgress: Download with id %d not found", msg.ID)
+	}
+	item.BytesReceived = msg.BytesReceived
+	item.TotalBytes = msg.TotalBytes
+	return nil
+}
+
+type DownloadErasedMsg struct {
+	ID int `json:"id"`
+}
+
+func (_ *DownloadErasedMsg) Name() string {
+	return "downloadErased"
+}
+
+func (msg *DownloadErasedMsg) Apply(store *TabStore) error {
+	delete(store.Downloads, msg.ID)
+	return nil
+}
+
+// Client methods
+
+// starts a download and returns its id
+func (client *TabsClient) Download(opts DownloadOptions) (int, error) {
+	response, err := client.Request(&Request{
+		Method: "download",
+		Props:  &opts,
+	})
+	if err != nil {
+		return -1, err
+	} else if response.Status != "success" {
+		return -1, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var id int
+	if err := json.Unmarshal(response.Info, &id); err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+func (client *TabsClient) ListDownloads(query *DownloadQuery) ([]*DownloadItem, error) {
+	response, err := client.Request(&Request{
+		Method: "listDownloads",
+		Props:  query,
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var items []*DownloadItem
+	if err := json.Unmarshal(response.Info, &items); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (client *TabsClient) PauseDownload(id int) error {
+	return client.downloadRequest("pauseDownload", id)
+}
+
+func (client *TabsClient) ResumeDownload(id int) error {
+	return client.downloadRequest("resumeDownload", id)
+}
+
+func (client *TabsClient) CancelDownload(id int) error {
+	return client.downloadRequest("cancelDownload", id)
+}
+
+func (client *TabsClient) downloadRequest(method string, id int) error {
+	if response, err := client.Request(&Request{
+		Method:     method,
+		DownloadId: id,
+	}); err != nil {
+		return err
+	} else if response.Status != "success" {
+		return fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	return nil
+}
+
+// follows the download through the events on events, which the caller
+// feeds from client.Updates, until it is no longer in progress
+// progress, if non-nil, is called with the download each time it changes
+func (client *TabsClient) WaitDownload(ctx context.Context, id int, events <-chan Event, progress func(*DownloadItem)) (*DownloadItem, error) {
+	type listing struct {
+		items []*DownloadItem
+		err   error
+	}
+	// the response arrives on the same connection as the events, so keep
+	// taking events while we wait for it
+	listed := make(chan listing, 1)
+	go func() {
+		items, err := client.ListDownloads(&DownloadQuery{ID: &id})
+		listed <- listing{items, err}
+	}()
+	store := MakeTabStore()
+	var item *DownloadItem
+	// events for the download that came before the listing; some may
+	// be older than it, but applied in order they leave every field as
+	// the browser last reported it
+	var early []Event
+	for {
+		changed := false
+		select {
+		case <-ctx.Done():
+			return item, ctx.Err()
+		case result := <-listed:
+			if result.err != nil {
+				return nil, result.err
+			}
+			if len(result.items) == 0 {
+				return nil, fmt.Errorf("Download %d not found", id)
+			}
+			item = result.items[0]
+			store.Downloads[id] = item
+			for _, event := range early {
+				event.Apply(store)
+			}
+			changed = true
+		case event, ok := <-events:
+			if !ok {
+				return item, errors.New("Stopped receiving events from the gateway")
+			}
+			switch e := event.(type) {
+			case *DownloadProgressMsg:
+				changed = e.ID == id
+			case *DownloadChangedMsg:
+				changed = e.ID == id
+			case *DownloadErasedMsg:
+				if e.ID == id {
+					return item, fmt.Errorf("Download %d was erased", id)
+				}
+			}
+			if changed && item == nil {
+				early = append(early, event)
+				continue
+			}
+			if changed {
+				event.Apply(store)
+			}
+		}
+		if !changed {
+			continue
+		}
+		if progress != nil {
+			progress(item)
+		}
+		if item.State != "in_progress" {
+			return item, nil
+		}
+	}
+}
+
+// e.g. "12.3 MiB / 40.0 MiB (30%)"
+func (item *DownloadItem) Progress() string {
+	if item.TotalBytes <= 0 {
+		return formatBytes(item.BytesReceived)
+	}
+	return fmt.Sprintf("%s / %s (%d%%)", formatBytes(item.BytesReceived), formatBytes(item.TotalBytes),
+		item.BytesReceived*100/item.TotalBytes)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,88 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestWaitDownloadFollowsEvents(t *testing.T) {
+	// left open: the client exits when it loses the gateway
+	clientEnd, gatewayEnd := net.Pipe()
+	client := MakeTabsClient()
+	client.gatewayConn = clientEnd
+	go client.listen()
+
+	events := make(chan Event)
+	listed := make(chan struct{})
+	go func() {
+		msg, err := ReadMsg(gatewayEnd)
+		if err != nil || msg.Request.Method != "listDownloads" {
+			return
+		}
+		// sent before the listing, and already reflected in it
+		events <- &DownloadProgressMsg{ID: 7, BytesReceived: 20, TotalBytes: 100}
+		info, _ := json.Marshal([]*DownloadItem{{ID: 7, State: "in_progress", BytesReceived: 20, TotalBytes: 100}})
+		SendMsg(gatewayEnd, &Message{Response: &Response{ID: msg.Request.ID, Status: "success", Info: info}})
+		close(listed)
+	}()
+	go func() {
+		<-listed
+		for _, event := range []Event{
+			&DownloadProgressMsg{ID: 8, BytesReceived: 99, TotalBytes: 100},
+			&DownloadProgressMsg{ID: 7, BytesReceived: 60, TotalBytes: 100},
+			&RemovedMsg{TabId: 7},
+			&DownloadChangedMsg{ID: 7, State: &Change[string]{Previous: "in_progress", Current: "complete"}},
+		} {
+			events <- event
+		}
+	}()
+
+	var seen []int64
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	item, err := client.WaitDownload(ctx, 7, events, func(item *DownloadItem) {
+		seen = append(seen, item.BytesReceived)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.State != "complete" {
+		t.Fatalf("WaitDownload returned a download that is %s, want complete", item.State)
+	}
+	// events may arrive before or after the listing they follow, but
+	// progress only moves forward and ends where the events left it
+	if len(seen) == 0 || seen[0] < 20 || seen[len(seen)-1] != 60 {
+		t.Fatalf("progress saw %v bytes, want 20 up to 60", seen)
+	}
+	for i := 1; i < len(seen); i++ {
+		if seen[i] < seen[i-1] {
+			t.Fatalf("progress went backwards: %v", seen)
+		}
+	}
+}
+
+func TestWaitDownloadErased(t *testing.T) {
+	clientEnd, gatewayEnd := net.Pipe()
+	client := MakeTabsClient()
+	client.gatewayConn = clientEnd
+	go client.listen()
+
+	events := make(chan Event)
+	go func() {
+		msg, err := ReadMsg(gatewayEnd)
+		if err != nil {
+			return
+		}
+		info, _ := json.Marshal([]*DownloadItem{{ID: 3, State: "in_progress"}})
+		SendMsg(gatewayEnd, &Message{Response: &Response{ID: msg.Request.ID, Status: "success", Info: info}})
+		events <- &DownloadErasedMsg{ID: 3}
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.WaitDownload(ctx, 3, events, nil); err == nil {
+		t.Fatal("WaitDownload on an erased download succeeded")
+	}
+}
@@ -0,0 +1,170 @@
+package tabs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type ExportOptions struct {
+	// include favicons from FavIconFile where available
+	Favicons bool
+	// if non-nil only tabs it matches are exported
+	Filter func(*Tab) bool
+}
+
+type Exporter func(w io.Writer, store *TabStore, opts ExportOptions) error
+
+var Exporters = map[string]Exporter{
+	"markdown": ExportMarkdown,
+	"org":      ExportOrg,
+	"html":     ExportHTML,
+	"json":     ExportJSON,
+}
+
+func tabTitle(tab *Tab) string {
+	if tab.Title == "" {
+		return tab.Url
+	}
+	return tab.Title
+}
+
+func ExportMarkdown(w io.Writer, store *TabStore, opts ExportOptions) error {
+	for i, window := range store.Windows(opts.Filter) {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "## Window %d\n\n", i+1)
+		for _, tab := range window {
+			icon := ""
+			if opts.Favicons && tab.FavIconFile != "" {
+				icon = fmt.Sprintf("![](file://%s) ", tab.FavIconFile)
+			}
+			if _, err := fmt.Fprintf(w, "- %s[%s](%s)\n", icon, markdownEscape(tabTitle(tab)), tab.Url); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+var orgEscaper = strings.NewReplacer("[", "{", "]", "}")
+
+func ExportOrg(w io.Writer, store *TabStore, opts ExportOptions) error {
+	for i, window := range store.Windows(opts.Filter) {
+		fmt.Fprintf(w, "* Window %d\n", i+1)
+		for _, tab := range window {
+			icon := ""
+			if opts.Favicons && tab.FavIconFile != "" {
+				icon = fmt.Sprintf("[[file:%s]] ", tab.FavIconFile)
+			}
+			if _, err := fmt.Fprintf(w, "** %s[[%s][%s]]\n", icon, tab.Url, orgEscaper.Replace(tabTitle(tab))); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writes the tabs as a Netscape bookmark file, one folder per window
+func ExportHTML(w io.Writer, store *TabStore, opts ExportOptions) error {
+	now := time.Now().Unix()
+	fmt.Fprint(w, `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+	for i, window := range store.Windows(opts.Filter) {
+		fmt.Fprintf(w, "    <DT><H3 ADD_DATE=\"%d\">Window %d</H3>\n    <DL><p>\n", now, i+1)
+		for _, tab := range window {
+			attrs := fmt.Sprintf(" ADD_DATE=\"%d\"", now)
+			if tab.LastAccessed > 0 {
+				attrs += fmt.Sprintf(" LAST_VISIT=\"%d\"", tab.LastAccessed/1000)
+			}
+			if opts.Favicons && tab.FavIconFile != "" {
+				if icon, err := faviconDataUrl(tab.FavIconFile); err == nil {
+					attrs += fmt.Sprintf(" ICON=\"%s\"", icon)
+				}
+			}
+			if _, err := fmt.Fprintf(w, "        <DT><A HREF=\"%s\"%s>%s</A>\n",
+				html.EscapeString(tab.Url), attrs, html.EscapeString(tabTitle(tab))); err != nil {
+				return err
+			}
+		}
+		fmt.Fprint(w, "    </DL><p>\n")
+	}
+	_, err := fmt.Fprint(w, "</DL><p>\n")
+	return err
+}
+
+func faviconDataUrl(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	mimeType := mime.TypeByExtension(filepath.Ext(filename))
+	if mimeType == "" {
+		mimeType = "image/png"
+	}
+	return fmt.Sprintf("data:%s;base64,%s", mimeType, base64.StdEncoding.EncodeToString(data)), nil
+}
+
+const ExportVersion = 1
+
+// The schema written by ExportJSON
+// Fields are only ever added, never renamed or removed, within a version
+type TabExport struct {
+	Version  int               `json:"version"`
+	Exported time.Time         `json:"exported"`
+	Windows  []TabExportWindow `json:"windows"`
+}
+
+type TabExportWindow struct {
+	ID   int            `json:"id"`
+	Tabs []TabExportTab `json:"tabs"`
+}
+
+type TabExportTab struct {
+	Url           string `json:"url"`
+	Title         string `json:"title"`
+	Pinned        bool   `json:"pinned"`
+	Active        bool   `json:"active"`
+	Hidden        bool   `json:"hidden"`
+	CookieStoreId string `json:"cookieStoreId,omitempty"`
+	LastAccessed  int    `json:"lastAccessed,omitempty"`
+	FavIconFile   string `json:"favIconFile,omitempty"`
+}
+
+func ExportJSON(w io.Writer, store *TabStore, opts ExportOptions) error {
+	export := TabExport{Version: ExportVersion, Exported: time.Now().UTC(), Windows: []TabExportWindow{}}
+	for _, window := range store.Windows(opts.Filter) {
+		exportWindow := TabExportWindow{ID: window[0].WindowId}
+		for _, tab := range window {
+			exportTab := TabExportTab{
+				Url:           tab.Url,
+				Title:         tab.Title,
+				Pinned:        tab.Pinned,
+				Active:        tab.Active,
+				Hidden:        tab.Hidden,
+				CookieStoreId: tab.CookieStoreId,
+				LastAccessed:  tab.LastAccessed,
+			}
+			if opts.Favicons {
+				exportTab.FavIconFile = tab.FavIconFile
+			}
+			exportWindow.Tabs = append(exportWindow.Tabs, exportTab)
+		}
+		export.Windows = append(export.Windows, exportWindow)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(&export)
+}
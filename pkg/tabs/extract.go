@@ -0,0 +1,164 @@
+package tabs
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Link struct {
+	Url  string `json:"url"`
+	Text string `json:"text"`
+}
+
+// The content of a page as returned by the "extract" method
+type PageContent struct {
+	Url       string `json:"url"`
+	Title     string `json:"title"`
+	IsArticle bool   `json:"isArticle"`
+	// the page's main text with navigation and other chrome removed
+	Text      string `json:"text"`
+	Selection string `json:"selection"`
+	// links pointing off the page, in document order
+	Links []Link `json:"links"`
+}
+
+// run in the top frame of the tab; evaluates to a PageContent
+const extractScript = `(() => {
+  const pick = () => {
+    for (const sel of ["article", "[role=main]", "main"]) {
+      const el = document.querySelector(sel)
+      if (el && el.innerText.trim().length > 200) return el
+    }
+    return document.body
+  }
+  // work on a copy in a detached document, which runs no scripts, loads
+  // nothing and leaves the page as it was
+  const doc = document.implementation.createHTMLDocument("")
+  const root = doc.importNode(pick(), true)
+  doc.body.appendChild(root)
+  root.querySelectorAll("script, style, noscript, template, nav, header, footer, aside, form, [hidden], [aria-hidden=true]")
+    .forEach((el) => el.remove())
+  // without layout there is no innerText, so mark where blocks end for
+  // textContent
+  root.querySelectorAll("p, div, li, dt, dd, tr, br, h1, h2, h3, h4, h5, h6, pre, blockquote, section, article, figcaption")
+    .forEach((el) => el.after("\n"))
+  const text = root.textContent
+    .replace(/[^\S\n]+/g, " ")
+    .replace(/ ?\n ?/g, "\n")
+    .replace(/\n{3,}/g, "\n\n")
+    .trim()
+
+  const here = location.href.split("#")[0]
+  const seen = new Set()
+  const links = []
+  for (const a of document.links) {
+    const url = a.href
+    if (!/^https?:/.test(url) || url.split("#")[0] === here || seen.has(url)) continue
+    seen.add(url)
+    links.push({url: url, text: a.innerText.trim().replace(/\s+/g, " ")})
+  }
+  return {
+    url: location.href,
+    title: document.title,
+    text: text,
+    selection: window.getSelection().toString(),
+    links: links,
+  }
+})()`
+
+func (client *TabsClient) Extract(ctx context.Context, tabId int) (*PageContent, error) {
+	response, err := client.RequestContext(ctx, &Request{
+		Method: "extract",
+		TabId:  tabId,
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Gateway responded: %s: %s", response.Status, string(response.Info))
+	}
+	var content PageContent
+	if err := json.Unmarshal(response.Info, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+func (g *Gateway) extract(request *Request, responses chan<- *Message) {
+	content, err := g.extractContent(request.TabId)
+	if err != nil {
+		responses <- &Message{Response: errorResponse(request.ID, err)}
+		return
+	}
+	info, err := json.Marshal(content)
+	if err != nil {
+		responses <- &Message{Response: errorResponse(request.ID, err)}
+		return
+	}
+	responses <- &Message{Response: &Response{ID: request.ID, Status: "success", Info: info}}
+}
+
+func (g *Gateway) extractContent(tabId int) (*PageContent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	response, err := g.browserRequest(ctx, &Request{
+		Method: "executeScript",
+		TabId:  tabId,
+		Props:  &InjectDetails{Code: ptr(extractScript)},
+	})
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Browser responded: %s: %s", response.Status, string(response.Info))
+	}
+	var results []*PageContent
+	if err := json.Unmarshal(response.Info, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 || results[0] == nil {
+		return nil, fmt.Errorf("No content extracted from tab %d", tabId)
+	}
+	content := results[0]
+	// the script can't tell, but the browser has told us
+	g.onLoop(func() {
+		if tab, exists := g.tabs.Open[tabId]; exists {
+			content.IsArticle = tab.IsArticle
+		}
+	})
+	return content, nil
+}
+
+// renders the content as a Markdown document
+func (p *PageContent) Markdown() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# [%s](%s)\n\n", markdownEscape(p.Title), p.Url)
+	if p.Selection != "" {
+		for _, line := range strings.Split(strings.TrimSpace(p.Selection), "\n") {
+			fmt.Fprintf(&b, "> %s\n", line)
+		}
+		b.WriteString("\n")
+	}
+	if p.Text != "" {
+		b.WriteString(p.Text)
+		b.WriteString("\n\n")
+	}
+	if len(p.Links) > 0 {
+		b.WriteString("## Links\n\n")
+		for _, link := range p.Links {
+			text := link.Text
+			if text == "" {
+				text = link.Url
+			}
+			fmt.Fprintf(&b, "- [%s](%s)\n", markdownEscape(text), link.Url)
+		}
+	}
+	return b.String()
+}
+
+var markdownEscaper = strings.NewReplacer("[", "\\[", "]", "\\]")
+
+func markdownEscape(s string) string {
+	return markdownEscaper.Replace(s)
+}
@@ -0,0 +1,84 @@
+package tabs
+
+import (
+	"log"
+	"sync"
+)
+
+var (
+	FaviconWorkers   = 4
+	FaviconQueueSize = 1024
+)
+
+type faviconJob struct {
+	hash string
+	tab  Tab
+}
+
+type faviconResult struct {
+	hash     string
+	filename string
+	tabIds   []int
+}
+
+// Resolves favicons on a bounded set of workers so that the gateway
+// does not block on sqlite or image decoding
+// Tabs sharing a FavIconUrl are coalesced into a single job
+type faviconPool struct {
+	processor *FaviconProcessor
+	jobs      chan faviconJob
+	results   chan faviconResult
+	mu        sync.Mutex
+	// tab ids waiting on each in-flight hash
+	pending map[string][]int
+}
+
+func makeFaviconPool(processor *FaviconProcessor, workers int) *faviconPool {
+	pool := &faviconPool{
+		processor: processor,
+		jobs:      make(chan faviconJob, FaviconQueueSize),
+		results:   make(chan faviconResult),
+		pending:   make(map[string][]int),
+	}
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+	return pool
+}
+
+// queues the tab's favicon for processing
+// the result is delivered on the results channel once ready
+func (p *faviconPool) Submit(tab *Tab) {
+	// caching the icon would leave a trace of where the tab has been
+	if tab.FavIconUrl == "" || (tab.Incognito && incognitoPrivate()) {
+		return
+	}
+	hash := favIconUrlHash(tab.FavIconUrl)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if waiting, exists := p.pending[hash]; exists {
+		p.pending[hash] = append(waiting, tab.ID)
+		return
+	}
+	select {
+	case p.jobs <- faviconJob{hash: hash, tab: *tab}:
+		p.pending[hash] = []int{tab.ID}
+	default:
+		log.Printf("favicon queue full, dropping favicon for %s", tab.Url)
+	}
+}
+
+func (p *faviconPool) work() {
+	for job := range p.jobs {
+		filename, err := p.processor.Process(&job.tab)
+		p.mu.Lock()
+		tabIds := p.pending[job.hash]
+		delete(p.pending, job.hash)
+		p.mu.Unlock()
+		if err != nil {
+			log.Printf("failed to get favicon file for %s: %s", job.tab.Url, err)
+			continue
+		}
+		p.results <- faviconResult{hash: job.hash, filename: filename, tabIds: tabIds}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"bytes"
 	"database/sql"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
 	"log"
-	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 
@@ -17,11 +19,12 @@ import (
 )
 
 var (
-	FaviconCacheDir = "/tmp/favicons"
+	FaviconCacheDir = filepath.Join(cacheDir(), "favicons")
 )
 
 type FaviconProcessor struct {
-	db *sql.DB
+	db    *sql.DB
+	cache *FileCache
 }
 
 func makeFaviconProcessor() *FaviconProcessor {
@@ -29,24 +32,30 @@ func makeFaviconProcessor() *FaviconProcessor {
 	if err != nil {
 		log.Fatal(err)
 	}
-	return &FaviconProcessor{db: db}
+	cache, err := MakeFaviconCache(FaviconCacheDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if removed, freed := cache.GC(); removed > 0 {
+		log.Printf("Evicted %d favicons (%d bytes) from cache", removed, freed)
+	}
+	return &FaviconProcessor{db: db, cache: cache}
 }
 
 // retrieves the favicon from the sqlite db if exists, or decodes FavIconUrl
-// writes the data to a file if it does not already exist
+// writes the data to the cache if it is not already there
 // returns the filename
 func (this *FaviconProcessor) Process(tab *Tab) (string, error) {
 	hash := favIconUrlHash(tab.FavIconUrl)
-	files, _ := filepath.Glob(fmt.Sprintf("%s/%s\\.*", FaviconCacheDir, hash))
-	if files != nil && len(files) == 1 {
-			return files[0], nil
-		}
+	if filename, exists := this.cache.Lookup(hash); exists {
+		return filename, nil
+	}
 	var (
 		data []byte
-	    ext string
-		err error
+		ext  string
+		err  error
 	)
-	if data, ext, err = this.decode(tab.FavIconUrl); err != nil {
+	if data, ext, err = decodeDataUrl(tab.FavIconUrl); err != nil {
 		log.Printf("unable to decode favicon, falling back to sqlite lookup: %s", tab.Url)
 		if data, ext, err = this.getFromSqlite(tab.Url); errors.Is(err, sql.ErrNoRows) {
 			log.Printf("no favicon found for %s", tab.Url)
@@ -61,15 +70,7 @@ func (this *FaviconProcessor) Process(tab *Tab) (string, error) {
 		}
 		ext = "png"
 	}
-	filename := fmt.Sprintf("%s/%s.%s", FaviconCacheDir, hash, ext)
-	faviconFile, err := os.Create(filename)
-	if err != nil {
-		return "", fmt.Errorf("Failed to create favicon file: %w", err)
-	}
-	if _, err := faviconFile.Write(data); err != nil {
-		return "", fmt.Errorf("Failed to write favicon: %w", err)
-	}
-	return filename, nil
+	return this.cache.Store(hash, ext, data)
 }
 
 func (this *FaviconProcessor) getFromSqlite(url string) (data []byte, ext string, err error) {
@@ -88,43 +89,208 @@ var (
 	extMap = map[string]string{
 		"data:image/x-icon":  "ico",
 		"data:image/png":     "png",
+		"data:image/jpeg":    "jpeg",
 		"data:image/svg+xml": "svg",
 		"data:image/webp":    "webp",
 	}
 )
 
-func (this *FaviconProcessor) decode(favIconUrl string) (data []byte, ext string, err error) {
-	iconType := strings.Split(favIconUrl, ";")[0]
+func decodeDataUrl(dataUrl string) (data []byte, ext string, err error) {
+	iconType := strings.Split(dataUrl, ";")[0]
 	ext, exists := extMap[iconType]
 	if !exists {
-		return nil, "", fmt.Errorf("FavIconUrl %s is not base64 decodable png or svg", favIconUrl)
+		return nil, "", fmt.Errorf("%s is not a base64 decodable image", iconType)
 	}
-	b64Str := strings.Split(favIconUrl, ",")[1]
+	parts := strings.SplitN(dataUrl, ",", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("%s has no data", iconType)
+	}
+	b64Str := parts[1]
 	data, err = base64.StdEncoding.DecodeString(b64Str)
 	if err != nil {
-		return nil, "", fmt.Errorf("Failed to decode favicon: %w", err)
+		return nil, "", fmt.Errorf("Failed to decode data url: %w", err)
 	}
 	return
 }
 
+// decodes an ICO container and re-encodes its best entry as PNG
+// entries may hold either an embedded PNG or a headerless BMP (DIB)
 func convertIcoToPng(favIconData []byte) ([]byte, error) {
+	entries, err := readIcoDir(favIconData)
+	if err != nil {
+		return nil, err
+	}
+	best := entries[0]
+	for _, entry := range entries[1:] {
+		if entry.betterThan(best) {
+			best = entry
+		}
+	}
+	data := favIconData[best.offset : best.offset+best.size]
+	if bytes.HasPrefix(data, pngHeader) {
+		return data, nil
+	}
+	img, err := decodeIcoBmp(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decode ico bitmap: %w", err)
+	}
 	var out bytes.Buffer
-	cmd := exec.Command("convert", "ico:-", "png:-")
-	cmd.Stdin = bytes.NewBuffer(favIconData)
-	cmd.Stdout = &out
-	if err := cmd.Run(); err != nil {
-		return nil, fmt.Errorf("Failed to run `convert`: %w", err)
-	}
-	pngData := out.Bytes()
-	// the resulting output may have several images
-	// grab the last one (typically the highest resolution)
-	// - look from back of buffer for PNG header (8950 4e47)
-	for i := len(pngData) - 4; i > 0; i-- {
-		if pngData[i] == 0x89 && pngData[i+1] == 0x50 && pngData[i+2] == 0x4e && pngData[i+3] == 0x47 {
-			return pngData[i:], nil
+	if err := png.Encode(&out, img); err != nil {
+		return nil, fmt.Errorf("Failed to encode png: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+var pngHeader = []byte{0x89, 'P', 'N', 'G', '\r', '\n', 0x1a, '\n'}
+
+type icoEntry struct {
+	width    int
+	height   int
+	bitCount int
+	size     int
+	offset   int
+}
+
+func (e icoEntry) betterThan(other icoEntry) bool {
+	if e.width*e.height != other.width*other.height {
+		return e.width*e.height > other.width*other.height
+	}
+	return e.bitCount > other.bitCount
+}
+
+func readIcoDir(data []byte) ([]icoEntry, error) {
+	if len(data) < 6 {
+		return nil, errors.New("ico data too short")
+	}
+	if binary.LittleEndian.Uint16(data[0:2]) != 0 || binary.LittleEndian.Uint16(data[2:4]) != 1 {
+		return nil, errors.New("not an ico file")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:6]))
+	if count == 0 {
+		return nil, errors.New("ico file has no images")
+	}
+	if len(data) < 6+16*count {
+		return nil, errors.New("ico directory truncated")
+	}
+	entries := make([]icoEntry, 0, count)
+	for i := 0; i < count; i++ {
+		d := data[6+16*i : 6+16*(i+1)]
+		entry := icoEntry{
+			width:    int(d[0]),
+			height:   int(d[1]),
+			bitCount: int(binary.LittleEndian.Uint16(d[6:8])),
+			size:     int(binary.LittleEndian.Uint32(d[8:12])),
+			offset:   int(binary.LittleEndian.Uint32(d[12:16])),
+		}
+		// a stored dimension of 0 means 256
+		if entry.width == 0 {
+			entry.width = 256
+		}
+		if entry.height == 0 {
+			entry.height = 256
+		}
+		if entry.offset < 0 || entry.size <= 0 || entry.offset+entry.size > len(data) {
+			log.Printf("skipping ico entry %d with bad bounds", i)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return nil, errors.New("ico file has no readable images")
+	}
+	return entries, nil
+}
+
+// decodes the BITMAPINFOHEADER-prefixed DIB stored in an ico entry
+// the stored height covers both the XOR (color) and AND (mask) bitmaps
+func decodeIcoBmp(data []byte) (image.Image, error) {
+	if len(data) < 40 {
+		return nil, errors.New("bitmap header truncated")
+	}
+	headerSize := int(binary.LittleEndian.Uint32(data[0:4]))
+	width := int(int32(binary.LittleEndian.Uint32(data[4:8])))
+	height := int(int32(binary.LittleEndian.Uint32(data[8:12]))) / 2
+	bitCount := int(binary.LittleEndian.Uint16(data[14:16]))
+	compression := binary.LittleEndian.Uint32(data[16:20])
+	colorsUsed := int(binary.LittleEndian.Uint32(data[32:36]))
+	if width <= 0 || height <= 0 || width > 1024 || height > 1024 {
+		return nil, fmt.Errorf("bad bitmap dimensions %dx%d", width, height)
+	}
+	// BI_RGB and BI_BITFIELDS (with the default 32bpp masks) only
+	if compression != 0 && compression != 3 {
+		return nil, fmt.Errorf("unsupported bitmap compression %d", compression)
+	}
+	if headerSize < 40 || headerSize > len(data) {
+		return nil, errors.New("bad bitmap header size")
+	}
+	pos := headerSize
+	if compression == 3 && headerSize == 40 {
+		pos += 12
+		if pos > len(data) {
+			return nil, errors.New("bitmap color masks truncated")
+		}
+	}
+
+	var palette color.Palette
+	if bitCount <= 8 {
+		if colorsUsed == 0 {
+			colorsUsed = 1 << bitCount
+		}
+		if pos+4*colorsUsed > len(data) {
+			return nil, errors.New("bitmap palette truncated")
+		}
+		palette = make(color.Palette, colorsUsed)
+		for i := range palette {
+			c := data[pos+4*i : pos+4*i+4]
+			palette[i] = color.NRGBA{R: c[2], G: c[1], B: c[0], A: 0xff}
+		}
+		pos += 4 * colorsUsed
+	}
+
+	switch bitCount {
+	case 1, 4, 8, 24, 32:
+	default:
+		return nil, fmt.Errorf("unsupported bitmap bit count %d", bitCount)
+	}
+	// rows are padded to 4 bytes and stored bottom-up
+	xorStride := ((width*bitCount + 31) / 32) * 4
+	andStride := ((width + 31) / 32) * 4
+	xorData := data[pos:]
+	if len(xorData) < xorStride*height {
+		return nil, errors.New("bitmap pixel data truncated")
+	}
+	andData := xorData[xorStride*height:]
+	hasMask := len(andData) >= andStride*height
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		row := xorData[(height-1-y)*xorStride:]
+		for x := 0; x < width; x++ {
+			var c color.NRGBA
+			switch bitCount {
+			case 32:
+				c = color.NRGBA{R: row[4*x+2], G: row[4*x+1], B: row[4*x], A: row[4*x+3]}
+			case 24:
+				c = color.NRGBA{R: row[3*x+2], G: row[3*x+1], B: row[3*x], A: 0xff}
+			default:
+				perByte := 8 / bitCount
+				shift := uint(8 - bitCount*(x%perByte+1))
+				idx := int(row[x/perByte]>>shift) & (1<<bitCount - 1)
+				if idx < len(palette) {
+					c = palette[idx].(color.NRGBA)
+				}
+			}
+			// 32bpp images carry their own alpha; the mask only applies below that
+			if bitCount < 32 && hasMask {
+				mask := andData[(height-1-y)*andStride:]
+				if mask[x/8]&(0x80>>uint(x%8)) != 0 {
+					c.A = 0
+				}
+			}
+			img.SetNRGBA(x, y, c)
 		}
 	}
-	return nil, fmt.Errorf("Did not find PNG header in `convert` output")
+	return img, nil
 }
 
 func favIconUrlHash(favIconUrl string) string {
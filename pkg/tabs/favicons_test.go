@@ -0,0 +1,330 @@
+package tabs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"testing"
+)
+
+// one image in an ico file
+type icoImage struct {
+	width    int
+	height   int
+	bitCount int
+	data     []byte
+}
+
+// lays out images in an ico container
+func icoFile(images ...icoImage) []byte {
+	header := make([]byte, 6+16*len(images))
+	binary.LittleEndian.PutUint16(header[2:4], 1)
+	binary.LittleEndian.PutUint16(header[4:6], uint16(len(images)))
+	offset := len(header)
+	var body []byte
+	for i, img := range images {
+		d := header[6+16*i:]
+		// 256 is stored as 0
+		d[0], d[1] = byte(img.width), byte(img.height)
+		binary.LittleEndian.PutUint16(d[4:6], 1)
+		binary.LittleEndian.PutUint16(d[6:8], uint16(img.bitCount))
+		binary.LittleEndian.PutUint32(d[8:12], uint32(len(img.data)))
+		binary.LittleEndian.PutUint32(d[12:16], uint32(offset))
+		offset += len(img.data)
+		body = append(body, img.data...)
+	}
+	return append(header, body...)
+}
+
+// a headerless bitmap as stored in an ico entry: rows are bottom-up and
+// already padded to 4 bytes, with the AND mask, if any, following the
+// color rows
+func dib(width, height, bitCount int, palette []color.NRGBA, pixels, mask []byte) []byte {
+	header := make([]byte, 40)
+	binary.LittleEndian.PutUint32(header[0:4], 40)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(width))
+	// the height covers both bitmaps
+	binary.LittleEndian.PutUint32(header[8:12], uint32(2*height))
+	binary.LittleEndian.PutUint16(header[12:14], 1)
+	binary.LittleEndian.PutUint16(header[14:16], uint16(bitCount))
+	binary.LittleEndian.PutUint32(header[32:36], uint32(len(palette)))
+	for _, c := range palette {
+		header = append(header, c.B, c.G, c.R, 0)
+	}
+	return append(append(header, pixels...), mask...)
+}
+
+func testPng(t testing.TB, width, height int, c color.NRGBA) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	var out bytes.Buffer
+	if err := png.Encode(&out, img); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+var (
+	red         = color.NRGBA{R: 0xff, A: 0xff}
+	green       = color.NRGBA{G: 0xff, A: 0xff}
+	blue        = color.NRGBA{B: 0xff, A: 0xff}
+	transparent = color.NRGBA{}
+)
+
+// a 2x2 image of one color, at any depth
+func solidDib(bitCount int, c color.NRGBA) []byte {
+	switch bitCount {
+	case 32:
+		return dib(2, 2, 32, nil, bytes.Repeat([]byte{c.B, c.G, c.R, c.A}, 4), nil)
+	case 24:
+		row := []byte{c.B, c.G, c.R, c.B, c.G, c.R, 0, 0}
+		return dib(2, 2, 24, nil, append(row, row...), nil)
+	}
+	return dib(2, 2, 8, []color.NRGBA{c}, make([]byte, 8), nil)
+}
+
+func TestConvertIcoToPng(t *testing.T) {
+	log.SetOutput(io.Discard)
+	embedded := testPng(t, 16, 16, green)
+	tests := []struct {
+		name string
+		ico  []byte
+		// top-down, left to right
+		want []color.NRGBA
+		// the size of the chosen image
+		width, height int
+	}{
+		{
+			name:  "embedded png",
+			ico:   icoFile(icoImage{16, 16, 32, embedded}),
+			want:  []color.NRGBA{green},
+			width: 16, height: 16,
+		},
+		{
+			name: "32bpp keeps its alpha",
+			ico: icoFile(icoImage{2, 2, 32, dib(2, 2, 32, nil, []byte{
+				// bottom row: blue, half-transparent red
+				0xff, 0, 0, 0xff, 0, 0, 0xff, 0x80,
+				// top row: green, transparent
+				0, 0xff, 0, 0xff, 0, 0, 0, 0,
+			}, nil)}),
+			want:  []color.NRGBA{green, transparent, blue, {R: 0xff, A: 0x80}},
+			width: 2, height: 2,
+		},
+		{
+			name: "8bpp paletted",
+			ico: icoFile(icoImage{2, 2, 8, dib(2, 2, 8, []color.NRGBA{red, green, blue}, []byte{
+				2, 1, 0, 0,
+				0, 2, 0, 0,
+			}, nil)}),
+			want:  []color.NRGBA{red, blue, blue, green},
+			width: 2, height: 2,
+		},
+		{
+			name: "1bpp paletted",
+			ico: icoFile(icoImage{2, 2, 1, dib(2, 2, 1, []color.NRGBA{red, blue}, []byte{
+				0x40, 0, 0, 0,
+				0x80, 0, 0, 0,
+			}, nil)}),
+			want:  []color.NRGBA{blue, red, red, blue},
+			width: 2, height: 2,
+		},
+		{
+			name: "AND mask makes pixels transparent",
+			ico: icoFile(icoImage{2, 2, 24, dib(2, 2, 24, nil, bytes.Repeat([]byte{0, 0, 0xff, 0, 0, 0xff, 0, 0}, 2), []byte{
+				// bottom row: left masked out
+				0x80, 0, 0, 0,
+				// top row: right masked out
+				0x40, 0, 0, 0,
+			})}),
+			want:  []color.NRGBA{red, {R: 0xff}, {R: 0xff}, red},
+			width: 2, height: 2,
+		},
+		{
+			name: "AND mask is ignored at 32bpp",
+			ico: icoFile(icoImage{2, 2, 32, dib(2, 2, 32, nil, bytes.Repeat([]byte{0, 0, 0xff, 0xff}, 4),
+				[]byte{0xc0, 0, 0, 0, 0xc0, 0, 0, 0})}),
+			want:  []color.NRGBA{red},
+			width: 2, height: 2,
+		},
+		{
+			name: "picks the largest image",
+			ico: icoFile(
+				icoImage{2, 2, 32, solidDib(32, red)},
+				icoImage{16, 16, 32, embedded},
+				icoImage{4, 4, 32, dib(4, 4, 32, nil, bytes.Repeat([]byte{0xff, 0, 0, 0xff}, 16), nil)},
+			),
+			want:  []color.NRGBA{green},
+			width: 16, height: 16,
+		},
+		{
+			name: "picks the deepest of the largest",
+			ico: icoFile(
+				icoImage{2, 2, 8, solidDib(8, red)},
+				icoImage{2, 2, 32, solidDib(32, green)},
+				icoImage{2, 2, 24, solidDib(24, blue)},
+			),
+			want:  []color.NRGBA{green},
+			width: 2, height: 2,
+		},
+		{
+			name: "skips entries that point past the end",
+			ico: func() []byte {
+				data := icoFile(icoImage{2, 2, 8, solidDib(8, red)}, icoImage{16, 16, 32, embedded})
+				// the png claims more bytes than there are
+				binary.LittleEndian.PutUint32(data[6+16+8:], uint32(len(embedded)+1))
+				return data
+			}(),
+			want:  []color.NRGBA{red},
+			width: 2, height: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := convertIcoToPng(test.ico)
+			if err != nil {
+				t.Fatal(err)
+			}
+			img, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("output is not a png: %v", err)
+			}
+			bounds := img.Bounds()
+			if bounds.Dx() != test.width || bounds.Dy() != test.height {
+				t.Fatalf("got a %dx%d image, want %dx%d", bounds.Dx(), bounds.Dy(), test.width, test.height)
+			}
+			for i := 0; i < bounds.Dx()*bounds.Dy(); i++ {
+				// a single color stands for the whole image
+				want := test.want[0]
+				if len(test.want) > 1 {
+					want = test.want[i]
+				}
+				x, y := i%bounds.Dx(), i/bounds.Dx()
+				got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+				if got != want {
+					t.Fatalf("pixel (%d, %d) is %v, want %v", x, y, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConvertIcoToPngRejects(t *testing.T) {
+	log.SetOutput(io.Discard)
+	valid := dib(2, 2, 8, []color.NRGBA{red}, make([]byte, 8), nil)
+	// a copy of the valid bitmap with its header changed
+	lying := func(offset int, value uint32) []byte {
+		data := append([]byte{}, valid...)
+		binary.LittleEndian.PutUint32(data[offset:], value)
+		return data
+	}
+	tests := []struct {
+		name string
+		ico  []byte
+	}{
+		{"empty", nil},
+		{"truncated header", []byte{0, 0, 1}},
+		{"cursor", []byte{0, 0, 2, 0, 1, 0}},
+		{"no images", icoFile()},
+		{"truncated directory", icoFile(icoImage{2, 2, 8, valid})[:20]},
+		{"entry past the end", icoFile(icoImage{2, 2, 8, valid})[:30]},
+		{"truncated bitmap header", icoFile(icoImage{2, 2, 8, valid[:39]})},
+		{"truncated palette", icoFile(icoImage{2, 2, 8, valid[:42]})},
+		{"truncated pixels", icoFile(icoImage{2, 2, 8, valid[:len(valid)-1]})},
+		{"header size past the end", icoFile(icoImage{2, 2, 8, lying(0, 1<<20)})},
+		{"header size too small", icoFile(icoImage{2, 2, 8, lying(0, 12)})},
+		{"zero width", icoFile(icoImage{2, 2, 8, lying(4, 0)})},
+		{"negative height", icoFile(icoImage{2, 2, 8, lying(8, 0xfffffffc)})},
+		{"huge width", icoFile(icoImage{2, 2, 8, lying(4, 1<<30)})},
+		{"height larger than the pixels", icoFile(icoImage{2, 2, 8, lying(8, 200)})},
+		{"palette larger than the data", icoFile(icoImage{2, 2, 8, lying(32, 1<<20)})},
+		{"palette size overflows", icoFile(icoImage{2, 2, 8, lying(32, 0xffffffff)})},
+		{"unsupported bit count", icoFile(icoImage{2, 2, 8, func() []byte {
+			data := append([]byte{}, valid...)
+			binary.LittleEndian.PutUint16(data[14:], 16)
+			return data
+		}()})},
+		{"unsupported compression", icoFile(icoImage{2, 2, 8, lying(16, 1)})},
+		{"bitfields without masks", icoFile(icoImage{2, 2, 32, func() []byte {
+			data := make([]byte, 40)
+			binary.LittleEndian.PutUint32(data[0:4], 40)
+			binary.LittleEndian.PutUint32(data[4:8], 1)
+			binary.LittleEndian.PutUint32(data[8:12], 2)
+			binary.LittleEndian.PutUint16(data[14:16], 32)
+			binary.LittleEndian.PutUint32(data[16:20], 3)
+			return data
+		}()})},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if data, err := convertIcoToPng(test.ico); err == nil {
+				t.Fatalf("got %d bytes, want an error", len(data))
+			}
+		})
+	}
+}
+
+func TestIcoEntryBetterThan(t *testing.T) {
+	tests := []struct {
+		a, b icoEntry
+		want bool
+	}{
+		{icoEntry{width: 32, height: 32, bitCount: 8}, icoEntry{width: 16, height: 16, bitCount: 32}, true},
+		{icoEntry{width: 16, height: 16, bitCount: 32}, icoEntry{width: 32, height: 32, bitCount: 8}, false},
+		{icoEntry{width: 16, height: 16, bitCount: 32}, icoEntry{width: 16, height: 16, bitCount: 24}, true},
+		{icoEntry{width: 16, height: 16, bitCount: 24}, icoEntry{width: 16, height: 16, bitCount: 24}, false},
+		// area, not either side, decides
+		{icoEntry{width: 64, height: 8}, icoEntry{width: 16, height: 16}, true},
+		{icoEntry{width: 256, height: 256, bitCount: 1}, icoEntry{width: 48, height: 48, bitCount: 32}, true},
+	}
+	for _, test := range tests {
+		if got := test.a.betterThan(test.b); got != test.want {
+			t.Errorf("%+v.betterThan(%+v) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+func TestReadIcoDirStoredZeroIs256(t *testing.T) {
+	entries, err := readIcoDir(icoFile(icoImage{256, 256, 32, testPng(t, 1, 1, red)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].width != 256 || entries[0].height != 256 {
+		t.Fatalf("got entries %+v, want one 256x256", entries)
+	}
+}
+
+func FuzzConvertIcoToPng(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Add(icoFile(icoImage{16, 16, 32, testPng(f, 16, 16, green)}))
+	f.Add(icoFile(icoImage{2, 2, 32, solidDib(32, red)}))
+	f.Add(icoFile(icoImage{2, 2, 24, solidDib(24, blue)}))
+	f.Add(icoFile(icoImage{2, 2, 8, solidDib(8, green)}, icoImage{2, 2, 1, dib(2, 2, 1, []color.NRGBA{red, blue}, make([]byte, 8), make([]byte, 8))}))
+	f.Add(icoFile(icoImage{2, 2, 4, dib(2, 2, 4, nil, make([]byte, 8), nil)}))
+	f.Add([]byte{0, 0, 1, 0, 1, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		out, err := convertIcoToPng(data)
+		if err != nil {
+			return
+		}
+		if !bytes.HasPrefix(out, pngHeader) {
+			t.Fatalf("got %d bytes that are not a png", len(out))
+		}
+		// embedded pngs are passed through as they are; anything we encode
+		// ourselves must decode
+		if bytes.Contains(data, out) {
+			return
+		}
+		if _, err := png.Decode(bytes.NewReader(out)); err != nil {
+			t.Fatalf("encoded an undecodable png: %v", err)
+		}
+	})
+}
@@ -0,0 +1,201 @@
+package tabs
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// evict least recently used icons once the cache grows past this
+	FaviconCacheMaxBytes int64 = 50 << 20
+	// evict icons that have not been used for this long
+	FaviconCacheMaxAge = 30 * 24 * time.Hour
+)
+
+type fileCacheEntry struct {
+	filename string
+	size     int64
+	lastUsed time.Time
+}
+
+// An on-disk cache of files (favicons, captures) keyed by hash
+// The index is rebuilt from the directory on startup; file mtimes double
+// as the last-used time so LRU order survives restarts
+type FileCache struct {
+	dir      string
+	maxBytes int64
+	maxAge   time.Duration
+	mu       sync.Mutex
+	index    map[string]*fileCacheEntry
+	size     int64
+}
+
+func MakeFaviconCache(dir string) (*FileCache, error) {
+	return makeFileCache(dir, FaviconCacheMaxBytes, FaviconCacheMaxAge)
+}
+
+func makeFileCache(dir string, maxBytes int64, maxAge time.Duration) (*FileCache, error) {
+	// cached favicons and captures show what was open, so keep them to
+	// ourselves, and don't follow a directory someone else left in our way
+	if err := makePrivateDir(dir); err != nil {
+		return nil, fmt.Errorf("Failed to create cache dir: %w", err)
+	}
+	cache := &FileCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		index:    make(map[string]*fileCacheEntry),
+	}
+	if err := cache.load(); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func (c *FileCache) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("Failed to read cache dir: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		// leftovers from an interrupted write
+		if strings.HasPrefix(name, ".cache-") {
+			os.Remove(filepath.Join(c.dir, name))
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		hash := strings.TrimSuffix(name, filepath.Ext(name))
+		c.index[hash] = &fileCacheEntry{
+			filename: filepath.Join(c.dir, name),
+			size:     info.Size(),
+			lastUsed: info.ModTime(),
+		}
+		c.size += info.Size()
+	}
+	return nil
+}
+
+// returns the cached file for hash, marking it as recently used
+func (c *FileCache) Lookup(hash string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.index[hash]
+	if !exists {
+		return "", false
+	}
+	if _, err := os.Stat(entry.filename); err != nil {
+		c.remove(hash)
+		return "", false
+	}
+	now := time.Now()
+	entry.lastUsed = now
+	os.Chtimes(entry.filename, now, now)
+	return entry.filename, true
+}
+
+// atomically writes data to the cache and evicts old entries if the
+// cache is over its size limit
+func (c *FileCache) Store(hash, ext string, data []byte) (string, error) {
+	tmp, err := os.CreateTemp(c.dir, ".cache-*")
+	if err != nil {
+		return "", fmt.Errorf("Failed to create cache file: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Failed to write cache file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Failed to write cache file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		log.Printf("failed to set cache file permissions: %v", err)
+	}
+	filename := filepath.Join(c.dir, fmt.Sprintf("%s.%s", hash, ext))
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("Failed to move cache file into place: %w", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, exists := c.index[hash]; exists && old.filename != filename {
+		c.remove(hash)
+	} else if exists {
+		c.size -= old.size
+	}
+	c.index[hash] = &fileCacheEntry{
+		filename: filename,
+		size:     int64(len(data)),
+		lastUsed: time.Now(),
+	}
+	c.size += int64(len(data))
+	if c.size > c.maxBytes {
+		c.evict(time.Now())
+	}
+	return filename, nil
+}
+
+// removes expired entries, then least recently used entries until the
+// cache fits in its size limit
+// returns the number of files removed and the bytes freed
+func (c *FileCache) GC() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.evict(time.Now())
+}
+
+func (c *FileCache) evict(now time.Time) (removed int, freed int64) {
+	hashes := make([]string, 0, len(c.index))
+	for hash := range c.index {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return c.index[hashes[i]].lastUsed.Before(c.index[hashes[j]].lastUsed)
+	})
+	for _, hash := range hashes {
+		entry := c.index[hash]
+		if c.size <= c.maxBytes && now.Sub(entry.lastUsed) <= c.maxAge {
+			// everything after this is newer
+			break
+		}
+		freed += entry.size
+		removed++
+		c.remove(hash)
+	}
+	return
+}
+
+// caller must hold c.mu
+func (c *FileCache) remove(hash string) {
+	entry, exists := c.index[hash]
+	if !exists {
+		return
+	}
+	if err := os.Remove(entry.filename); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove cached file %s: %v", entry.filename, err)
+	}
+	c.size -= entry.size
+	delete(c.index, hash)
+}
+
+// returns the number of files and total bytes in the cache
+func (c *FileCache) Stats() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.index), c.size
+}
@@ -2,12 +2,16 @@ package tabs
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net"
 	"os"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -19,14 +23,25 @@ import (
  */
 
 var (
-	GatewaySockAddr = "/tmp/browser_gateway.sock"
+	GatewaySockAddr = filepath.Join(runtimeDir(), "gateway.sock")
 	GatewayLogfile  = "/home/francis/Projects/firefox-extension/gateway.log"
 	FirefoxProfile  = "/home/francis/.mozilla/firefox/w7ib4vbq.dev-edition-default"
 )
 
+// A connected client
+type client struct {
+	// the profile it authenticated as
+	profile *Profile
+	out     *outbox
+}
+
 type Gateway struct {
-	tabs        *TabStore
-	connections []net.Conn
+	tabs *TabStore
+	// every client that has authenticated
+	connections map[clientConn]*client
+	// guards connections
+	connMu   sync.Mutex
+	profiles *Profiles
 	// receive Response and Events from browser
 	inStream chan *Message
 	// send Requests from connections to browser
@@ -34,18 +49,72 @@ type Gateway struct {
 	// since we will be forwarding these onward, send these as generic
 	// messages rather than Responses to avoid needless unwrap/rewrap
 	requests map[uuid.UUID]chan *Message
-	favicons *FaviconProcessor
+	// guards requests
+	mu       sync.Mutex
+	favicons *faviconPool
+	// nil unless GatewayAssetAddr is set
+	assets *assetServer
+	// nil unless CaptureCacheDir is set
+	captures *FileCache
+	rules    []*Rule
+	// nil when no limits are configured
+	limits   *TabLimits
+	activity *activityTracker
+	groups   *tabGroups
+	// group requests from connections, handled on the event loop
+	groupCalls chan groupCall
+	// functions to run on the event loop, see onLoop
+	loopCalls chan func()
+	// automatic actions (rules, limits) sent to the browser but not yet
+	// reflected in tabs
+	pending map[string]time.Time
+	// actions that must reach the browser in order, see runActions
+	actions *actionQueue
 }
 
 func MakeGateway() *Gateway {
-	return &Gateway{
+	g := &Gateway{
 		tabs:        MakeTabStore(),
-		connections: []net.Conn{},
+		connections: make(map[clientConn]*client),
 		requests:    make(map[uuid.UUID]chan *Message),
 		inStream:    make(chan *Message),
 		outStream:   make(chan *Message),
-		favicons:    makeFaviconProcessor(),
+		favicons:    makeFaviconPool(makeFaviconProcessor(), FaviconWorkers),
+		pending:     make(map[string]time.Time),
+		activity:    makeActivityTracker(ActivityFile),
+		groups:      makeTabGroups(GroupsFile),
+		groupCalls:  make(chan groupCall),
+		loopCalls:   make(chan func()),
+		actions:     makeActionQueue(),
+	}
+	if rules, err := LoadRules(RulesFile); err != nil {
+		log.Printf("ERROR: failed to load rules from %s: %v", RulesFile, err)
+	} else {
+		g.rules = rules
+	}
+	profiles, err := LoadProfiles(ProfilesFile)
+	if err != nil {
+		// running without the restrictions the user asked for is worse
+		// than not running
+		log.Fatalf("ERROR: failed to load profiles from %s: %v", ProfilesFile, err)
+	}
+	g.profiles = profiles
+	if err := checkIncognitoPolicy(IncognitoPolicy); err != nil {
+		log.Fatalf("ERROR: %v", err)
 	}
+	if limits, err := LoadLimits(LimitsFile); err != nil {
+		log.Printf("ERROR: failed to load limits from %s: %v", LimitsFile, err)
+	} else {
+		g.limits = limits
+	}
+	if CaptureCacheDir != "" {
+		captures, err := MakeCaptureCache(CaptureCacheDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		g.captures = captures
+	}
+	return g
 }
 
 func (g *Gateway) Start() {
@@ -59,19 +128,71 @@ func (g *Gateway) Start() {
 
 	log.Printf("PID is %d", os.Getpid())
 
+	if GatewayAssetAddr != "" {
+		caches := map[string]*FileCache{"favicon": g.favicons.processor.cache}
+		if g.captures != nil {
+			caches["capture"] = g.captures
+		}
+		assets, err := startAssetServer(GatewayAssetAddr, caches)
+		if err != nil {
+			log.Printf("ERROR: failed to start asset server: %v", err)
+		} else {
+			g.assets = assets
+		}
+	}
+
+	if GatewayWebSocketAddr != "" {
+		go func() {
+			if err := g.listenWebSocket(GatewayWebSocketAddr); err != nil {
+				log.Printf("ERROR: websocket listener: %v", err)
+			}
+		}()
+	}
+
+	if GatewayJsonRpcAddr != "" {
+		go func() {
+			if err := g.listenJsonRpc(GatewayJsonRpcAddr); err != nil {
+				log.Printf("ERROR: JSON-RPC listener: %v", err)
+			}
+		}()
+	}
+
 	// send messages from all connections to stdout
 	go func() {
 		for msg := range g.outStream {
-			if err := SendMsg(os.Stdout, msg); err != nil {
+			err := sendMsgLimit(os.Stdout, msg, MaxBrowserMsgSize)
+			if errors.Is(err, ErrMsgTooLarge) && msg.Request != nil {
+				// the browser would drop us for sending it
+				g.failRequest(msg.Request, err)
+			} else if err != nil {
 				log.Fatalf("Failed to write to stdout (???): %v", err)
 			}
 		}
 	}()
 
+	go g.runActions()
+
 	go func() {
-		for msg := range g.inStream {
-			if err := g.handleMessage(msg); err != nil {
-				log.Printf("ERROR: handling msg: %v", err)
+		ticker := time.NewTicker(RulesInterval)
+		defer ticker.Stop()
+		checkpoints := time.NewTicker(ActivityCheckpointInterval)
+		defer checkpoints.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				g.evaluateRules(g.tabs.List())
+			case now := <-checkpoints.C:
+				g.activity.checkpoint(now)
+			case msg := <-g.inStream:
+				if err := g.handleMessage(msg); err != nil {
+					log.Printf("ERROR: handling msg: %v", err)
+				}
+			case call := <-g.groupCalls:
+				g.handleGroupCall(call)
+			case f := <-g.loopCalls:
+				f()
+			case result := <-g.favicons.results:
+				g.applyFavicon(result)
 			}
 		}
 	}()
@@ -84,89 +205,297 @@ func (g *Gateway) Start() {
 			if err == io.EOF {
 				log.Printf("Received EOF from browser")
 				os.Exit(0)
-			} else if err != nil {
-				log.Printf("ERROR: %#v", err)
+			} else if recoverableMsgError(err) {
+				log.Printf("ERROR: from browser: %v", err)
 				continue
+			} else if err != nil {
+				// we can't find the next message, and the browser won't
+				// resend; it will start a new gateway when next needed
+				log.Fatalf("ERROR: lost track of messages from browser: %v", err)
 			}
 			g.inStream <- msg
 		}
 	}()
 
-	responseChan := make(chan *Message)
-	request := &Request{ID: uuid.New(), Method: "list"}
-	g.requests[request.ID] = responseChan
-	g.outStream <- &Message{Request: request}
-
-	msg := <-responseChan
-	delete(g.requests, request.ID)
-	if msg.Response == nil || msg.Response.Status != "list" {
-		log.Fatalf("Unexpected response to initial query: %v", msg)
+	response, err := g.browserRequest(context.Background(), &Request{Method: "list"})
+	if err != nil || response.Status != "list" {
+		log.Fatalf("Unexpected response to initial query: %v %v", response, err)
 	}
 	var tabs []*Tab
-	if err := json.Unmarshal(msg.Response.Info, &tabs); err != nil {
+	if err := json.Unmarshal(response.Info, &tabs); err != nil {
 		log.Fatalf("Unable to read tab list: %v", err)
 	}
 	log.Printf("Received %d tabs from browser", len(tabs))
-	for _, tab := range tabs {
-		if filename, err := g.favicons.Process(tab); err != nil {
-			log.Printf("failed to get favicon file for %s: %s", tab.Url, err)
+	g.onLoop(func() {
+		for _, tab := range tabs {
+			g.tabs.Open[tab.ID] = tab
+		}
+		// Submit copies the tab, which events may be changing by now
+		for _, tab := range tabs {
+			g.favicons.Submit(tab)
+		}
+	})
+	if response, err := g.browserRequest(context.Background(), &Request{Method: "listContainers"}); err != nil || response.Status != "success" {
+		log.Printf("Unable to list containers: %v %v", response, err)
+	} else {
+		var containers []*Container
+		if err := json.Unmarshal(response.Info, &containers); err != nil {
+			log.Printf("Unable to read container list: %v", err)
+		}
+		g.onLoop(func() {
+			for _, container := range containers {
+				g.tabs.Containers[container.CookieStoreId] = container
+			}
+		})
+	}
+	if response, err := g.browserRequest(context.Background(), &Request{
+		Method: "listDownloads",
+		Props:  &DownloadQuery{State: ptr("in_progress")},
+	}); err != nil || response.Status != "success" {
+		log.Printf("Unable to list downloads: %v %v", response, err)
+	} else {
+		var downloads []*DownloadItem
+		if err := json.Unmarshal(response.Info, &downloads); err != nil {
+			log.Printf("Unable to read download list: %v", err)
+		}
+		g.onLoop(func() {
+			for _, item := range downloads {
+				g.tabs.Downloads[item.ID] = item
+			}
+		})
+	}
+	g.onLoop(func() {
+		if err := g.groups.load(g.tabs); err != nil {
+			log.Printf("ERROR: failed to load groups from %s: %v", GroupsFile, err)
+		}
+		g.activity.start(g.tabs, time.Now())
+	})
+	if GatewayDBus {
+		if bus, err := startDBus(); err != nil {
+			log.Printf("ERROR: failed to register on D-Bus: %v", err)
 		} else {
-			log.Printf("Favicon file is %s for %s", filename, tab.Url)
-			tab.FavIconFile = filename
+			// the session bus is already private to us
+			g.addConn(bus, false)
 		}
-		g.tabs.Open[tab.ID] = tab
 	}
 	g.listenForConnections()
 }
 
+// runs f on the event loop and waits for it to finish
+// the event loop is the only place the gateway's state may be touched
+// once it has started
+func (g *Gateway) onLoop(f func()) {
+	done := make(chan struct{})
+	g.loopCalls <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
 func (g *Gateway) handleMessage(msg *Message) error {
 	switch {
 	case msg.Request != nil:
 		g.outStream <- msg
 	case msg.Response != nil:
 		response := msg.Response
-		if responseChan, exists := g.requests[response.ID]; !exists {
+		g.mu.Lock()
+		responseChan, exists := g.requests[response.ID]
+		delete(g.requests, response.ID)
+		g.mu.Unlock()
+		if !exists {
 			return fmt.Errorf("Received response for non-outstanding request")
-		} else {
-			delete(g.requests, response.ID)
-			responseChan <- msg
 		}
+		responseChan <- msg
 	case msg.Event != nil:
+		g.broadcast(msg)
+		g.activity.observe(g.tabs, msg.Event, time.Now())
+		g.observeGroups(msg.Event)
+		if tab, exists := g.tabs.Open[eventTabId(msg.Event)]; exists {
+			g.evaluateRules([]*Tab{tab})
+		}
+		// favicons are resolved in the background; the file is sent
+		// to clients as a follow-up update once it is ready
 		switch event := msg.Event.(type) {
 		case *UpdatedMsg:
 			if event.Delta.FavIconUrl != nil {
 				if tab, exists := g.tabs.Open[event.TabId]; exists {
-					if filename, err := g.favicons.Process(tab); err != nil {
-						return fmt.Errorf("failed to get favicon file for %s: %s", tab.Url, err)
-					} else {
-						event.Delta.FavIconFile = &filename
-					}
+					g.favicons.Submit(tab)
 				}
 			}
 		case *CreatedMsg:
 			if tab, exists := g.tabs.Open[event.ID]; exists {
-				if filename, err := g.favicons.Process(tab); err != nil {
-					log.Printf("failed to get favicon file for %s: %s", tab.Url, err)
-				} else {
-					event.FavIconFile = filename
-				}
+				g.favicons.Submit(tab)
+				g.enforceLimits(tab)
 			}
 		}
-		msg.Event.Apply(g.tabs)
-		for _, conn := range g.connections {
-			if err := SendMsg(conn, msg); err != nil {
-				log.Printf("ERROR: Failed to send msg to %v: %v", conn, err)
+	}
+	return nil
+}
+
+// sends the request to the browser; the response is delivered on responses
+func (g *Gateway) forward(msg *Message, responses chan *Message) {
+	g.mu.Lock()
+	g.requests[msg.Request.ID] = responses
+	g.mu.Unlock()
+	g.outStream <- msg
+}
+
+// answers a request that could not be sent to the browser
+func (g *Gateway) failRequest(request *Request, err error) {
+	g.mu.Lock()
+	responses, exists := g.requests[request.ID]
+	delete(g.requests, request.ID)
+	g.mu.Unlock()
+	if exists {
+		responses <- &Message{Response: errorResponse(request.ID, err)}
+	}
+}
+
+// makes a request of the browser on the gateway's own behalf
+func (g *Gateway) browserRequest(ctx context.Context, request *Request) (*Response, error) {
+	request.ID = uuid.New()
+	// buffered so that a late response does not block handleMessage
+	responses := make(chan *Message, 1)
+	g.forward(&Message{Request: request}, responses)
+	select {
+	case <-ctx.Done():
+		g.mu.Lock()
+		delete(g.requests, request.ID)
+		g.mu.Unlock()
+		return nil, fmt.Errorf("Request %s failed: %w", request.Method, ctx.Err())
+	case msg := <-responses:
+		return msg.Response, nil
+	}
+}
+
+// records that the action identified by key is under way
+// returns false if it already was and has not yet timed out
+// must be called from the gateway's event loop
+func (g *Gateway) startAction(key string, now time.Time) bool {
+	if started, exists := g.pending[key]; exists && now.Sub(started) < pendingActionTimeout {
+		return false
+	}
+	g.pending[key] = now
+	return true
+}
+
+// forgets actions that have timed out
+func (g *Gateway) expireActions(now time.Time) {
+	for key, started := range g.pending {
+		if now.Sub(started) > pendingActionTimeout {
+			delete(g.pending, key)
+		}
+	}
+}
+
+// sends a request on the gateway's behalf without waiting on the result
+// beyond logging failures
+func (g *Gateway) act(description string, request *Request) {
+	ctx, cancel := context.WithTimeout(context.Background(), pendingActionTimeout)
+	defer cancel()
+	response, err := g.browserRequest(ctx, request)
+	if err != nil {
+		log.Printf("ERROR: %s: %v", description, err)
+	} else if response.Status != "success" {
+		log.Printf("ERROR: %s: browser responded %s: %s",
+			description, response.Status, string(response.Info))
+	}
+}
+
+// A request the gateway makes of its own accord
+type action struct {
+	description string
+	request     *Request
+}
+
+// Actions waiting to be sent, in order
+// push never blocks, so the event loop can queue actions whose responses
+// it has yet to deliver
+type actionQueue struct {
+	mu      sync.Mutex
+	actions []action
+	// signalled when actions are pushed
+	wake chan struct{}
+}
+
+func makeActionQueue() *actionQueue {
+	return &actionQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *actionQueue) push(actions ...action) {
+	if len(actions) == 0 {
+		return
+	}
+	q.mu.Lock()
+	q.actions = append(q.actions, actions...)
+	q.mu.Unlock()
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// returns the next action, or false if there is none
+func (q *actionQueue) pop() (action, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.actions) == 0 {
+		return action{}, false
+	}
+	next := q.actions[0]
+	q.actions = q.actions[1:]
+	return next, true
+}
+
+// sends queued actions one at a time, each after the last has been
+// answered, so that they reach the browser in the order they were queued
+func (g *Gateway) runActions() {
+	for range g.actions.wake {
+		for {
+			next, exists := g.actions.pop()
+			if !exists {
+				break
 			}
+			g.act(next.description, next.request)
 		}
 	}
-	return nil
 }
 
-func (g *Gateway) listenForConnections() {
-	if err := os.RemoveAll(GatewaySockAddr); err != nil {
-		log.Fatal(err)
+func (g *Gateway) broadcast(msg *Message) {
+	private := privateEvent(g.tabs, msg.Event)
+	if err := msg.Event.Apply(g.tabs); err != nil {
+		log.Printf("ERROR: applying event: %v", err)
 	}
-	l, err := net.Listen("unix", GatewaySockAddr)
+	g.connMu.Lock()
+	defer g.connMu.Unlock()
+	for _, c := range g.connections {
+		if !c.profile.Allows(ScopeRead) {
+			continue
+		}
+		if event := redactEvent(msg.Event, private, incognitoView(c.profile)); event != nil {
+			c.out.offer(&Message{Event: event})
+		}
+	}
+}
+
+func (g *Gateway) applyFavicon(result faviconResult) {
+	for _, tabId := range result.tabIds {
+		tab, exists := g.tabs.Open[tabId]
+		// the tab may have closed or changed icons while we were working
+		if !exists || favIconUrlHash(tab.FavIconUrl) != result.hash {
+			continue
+		}
+		delta := TabDelta{FavIconFile: &result.filename}
+		if g.assets != nil {
+			delta.FavIconFileUrl = ptr(g.assets.Url("favicon", result.hash))
+		}
+		g.broadcast(&Message{Event: &UpdatedMsg{TabId: tabId, Delta: delta}})
+	}
+}
+
+func (g *Gateway) listenForConnections() {
+	l, err := listenUnix(GatewaySockAddr)
 	if err != nil {
 		log.Fatal("ERROR: listening: ", err)
 	}
@@ -177,32 +506,56 @@ func (g *Gateway) listenForConnections() {
 		if err != nil {
 			log.Fatal("ERROR: accept: ", err)
 		}
-		g.connections = append(g.connections, conn)
-		log.Println("New client connected")
-		go g.listenConn(conn)
+		if err := checkPeer(conn); err != nil {
+			log.Printf("ERROR: refusing client: %v", err)
+			conn.Close()
+			continue
+		}
+		g.addConn(makeStreamConn(conn), false)
 	}
 }
 
-func (g *Gateway) listenConn(conn net.Conn) {
+// starts serving a newly accepted client
+// clients on transports that anyone on the machine could reach must
+// present GatewayToken first
+func (g *Gateway) addConn(conn clientConn, needsToken bool) {
+	log.Printf("New client connected: %v", conn)
+	go g.listenConn(conn, needsToken)
+}
+
+func (g *Gateway) listenConn(conn clientConn, needsToken bool) {
 	defer g.closeConn(conn)
-	// every connection gets a channel
-	msgChan := make(chan *Message)
-	go func(c net.Conn, msgs chan *Message) {
-		for msg := range msgs {
-			SendMsg(c, msg)
+	profile := g.profiles.unauthenticated()
+	if needsToken && GatewayToken != "" {
+		var err error
+		if profile, err = authenticate(conn, g.profiles); err != nil {
+			log.Printf("ERROR: %v failed to authenticate: %v", conn, err)
+			return
 		}
-	}(conn, msgChan)
+	}
+	log.Printf("%v has profile %s", conn, profile.Name)
+	out := makeOutbox(conn)
+	defer out.close()
+	// only now may the client hear about events
+	g.connMu.Lock()
+	g.connections[conn] = &client{profile: profile, out: out}
+	g.connMu.Unlock()
 
 	// I think this works???
 	// cIn := bufio.NewReader(conn)
 	for {
-		msg, err := ReadMsg(conn)
+		msg, err := conn.ReadMsg()
 		if err == io.EOF {
 			log.Printf("Received EOF from client")
 			break
-		} else if err != nil {
-			log.Printf("ERROR: %#v", err)
+		} else if recoverableMsgError(err) {
+			log.Printf("ERROR: from %v: %v", conn, err)
 			continue
+		} else if err != nil {
+			// the client is either broken or hostile; either way, no
+			// point reading further
+			log.Printf("ERROR: dropping %v: %v", conn, err)
+			break
 		}
 
 		request := msg.Request
@@ -210,32 +563,87 @@ func (g *Gateway) listenConn(conn net.Conn) {
 			log.Printf("ERROR: Received non-request from client: %v", msg)
 			continue
 		}
+		if err := profile.check(request.Method); err != nil {
+			log.Printf("Denied %v: %v", conn, err)
+			conn.SendMsg(&Message{Response: deniedResponse(request, err.(*ScopeError))})
+			continue
+		}
+		// whether the request acts on an incognito tab or download
+		var private error
+		if incognitoPrivate() {
+			g.onLoop(func() { private = g.incognitoTarget(request) })
+		}
+		if private != nil && incognitoView(profile) != IncognitoShow {
+			// as far as the client knows, there is no such tab
+			log.Printf("Denied %v: %s on an incognito tab or download", conn, request.Method)
+			conn.SendMsg(&Message{Response: errorResponse(request.ID, private)})
+			continue
+		}
 		switch request.Method {
+		case "authenticate":
+			// switch to another profile
+			authenticated, err := g.profiles.authenticate(request)
+			if err != nil {
+				conn.SendMsg(&Message{Response: errorResponse(request.ID, err)})
+				break
+			}
+			profile = authenticated
+			log.Printf("%v now has profile %s", conn, profile.Name)
+			g.connMu.Lock()
+			g.connections[conn].profile = profile
+			g.connMu.Unlock()
+			conn.SendMsg(&Message{Response: &Response{ID: request.ID, Status: "success"}})
 		case "list":
 			var response *Response
-			currentTabs := g.tabs.List()
-			if content, err := json.Marshal(currentTabs); err != nil {
+			var content []byte
+			var err error
+			g.onLoop(func() {
+				content, err = json.Marshal(redactTabs(g.tabs.List(), incognitoView(profile)))
+			})
+			if err != nil {
 				errMsg := fmt.Sprintf("ERROR: Failed to list tabs: %v", err)
 				log.Printf(errMsg)
 				response = &Response{ID: request.ID, Status: "error", Info: []byte(errMsg)}
 			} else {
 				response = &Response{ID: request.ID, Status: "success", Info: content}
 			}
-			SendMsg(conn, &Message{Response: response})
+			conn.SendMsg(&Message{Response: response})
+		case "captureTab":
+			responses := out.response()
+			// incognito captures are never written to disk
+			if g.captures != nil && private == nil {
+				cached := responses
+				responses = make(chan *Message, 1)
+				go g.cacheCapture(responses, cached)
+			}
+			g.forward(msg, responses)
+		case "query", "listDownloads":
+			responses := out.response()
+			if view := incognitoView(profile); view != IncognitoShow {
+				redacted := responses
+				responses = make(chan *Message, 1)
+				go redactResponse(request.Method, view, responses, redacted)
+			}
+			g.forward(msg, responses)
+		case "extract":
+			go g.extract(request, out.response())
+		case "listGroups", "createGroup", "assignGroup", "switchGroup", "removeGroup":
+			g.groupCalls <- groupCall{request: request, responses: out.response()}
 		default:
-			g.requests[request.ID] = msgChan
-			g.outStream <- msg
+			g.forward(msg, out.response())
 		}
 	}
 }
 
-func (g *Gateway) closeConn(conn net.Conn) {
+func errorResponse(id uuid.UUID, err error) *Response {
+	info, _ := json.Marshal(err.Error())
+	return &Response{ID: id, Status: "error", Info: info}
+}
+
+func (g *Gateway) closeConn(conn clientConn) {
 	log.Printf("Closing connection %v", conn)
-	for i, c := range g.connections {
-		if conn == c {
-			g.connections = append(g.connections[:i], g.connections[i+1:]...)
-			break
-		}
-	}
+	g.connMu.Lock()
+	delete(g.connections, conn)
+	g.connMu.Unlock()
 	conn.Close()
 }
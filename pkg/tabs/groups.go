@@ -0,0 +1,391 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var (
+	GroupsFile = filepath.Join(dataDir(), "groups.json")
+)
+
+// Named groups of tabs. Each window shows the tabs of its active group
+// and hides those belonging to any other group; ungrouped and pinned
+// tabs are always shown.
+type TabGroup struct {
+	Name   string `json:"name"`
+	TabIds []int  `json:"tabIds"`
+	// the windows this group is showing in
+	ActiveIn []int `json:"activeIn"`
+}
+
+type GroupProperties struct {
+	// the empty name means no group: ungroup tabs, or show every tab
+	Name     string `json:"name"`
+	WindowId int    `json:"windowId,omitempty"`
+}
+
+// Tab ids change across browser restarts, so membership is saved by url
+type groupsFile struct {
+	Groups  []string          `json:"groups"`
+	Members map[string]string `json:"members"`
+}
+
+type tabGroups struct {
+	filename string
+	// in creation order, including empty groups
+	names []string
+	// tab id -> group
+	byTab map[int]string
+	// window id -> group it is showing; no entry shows every tab
+	active map[int]string
+}
+
+// a group request from a client, answered on the gateway's event loop
+type groupCall struct {
+	request   *Request
+	responses chan<- *Message
+}
+
+func makeTabGroups(filename string) *tabGroups {
+	return &tabGroups{
+		filename: filename,
+		byTab:    make(map[int]string),
+		active:   make(map[int]string),
+	}
+}
+
+// assigns the open tabs in store to their saved groups and works out
+// which group each window was showing from what is visible
+func (groups *tabGroups) load(store *TabStore) error {
+	data, err := os.ReadFile(groups.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var saved groupsFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("Failed to parse groups: %w", err)
+	}
+	groups.names = saved.Groups
+	for _, tab := range store.Open {
+		if name, exists := saved.Members[tab.Url]; exists && groups.exists(name) {
+			groups.byTab[tab.ID] = name
+		}
+	}
+	for _, window := range store.Windows(nil) {
+		var showing string
+		for _, tab := range window {
+			name := groups.byTab[tab.ID]
+			if name == "" || tab.Hidden {
+				continue
+			}
+			if tab.Active || showing == "" {
+				showing = name
+			}
+			if tab.Active {
+				break
+			}
+		}
+		if showing != "" {
+			groups.active[window[0].WindowId] = showing
+		}
+	}
+	return nil
+}
+
+func (groups *tabGroups) save(store *TabStore) error {
+	saved := groupsFile{Groups: groups.names, Members: make(map[string]string)}
+	for tabId, name := range groups.byTab {
+		if tab, exists := store.Open[tabId]; exists && !tab.Incognito {
+			saved.Members[tab.Url] = name
+		}
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(groups.filename, data)
+}
+
+func (groups *tabGroups) exists(name string) bool {
+	for _, n := range groups.names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (groups *tabGroups) list() []*TabGroup {
+	byName := make(map[string]*TabGroup)
+	list := []*TabGroup{}
+	for _, name := range groups.names {
+		group := &TabGroup{Name: name, TabIds: []int{}, ActiveIn: []int{}}
+		byName[name] = group
+		list = append(list, group)
+	}
+	for tabId, name := range groups.byTab {
+		byName[name].TabIds = append(byName[name].TabIds, tabId)
+	}
+	for windowId, name := range groups.active {
+		byName[name].ActiveIn = append(byName[name].ActiveIn, windowId)
+	}
+	for _, group := range list {
+		sort.Ints(group.TabIds)
+		sort.Ints(group.ActiveIn)
+	}
+	return list
+}
+
+// keeps group membership in step with tab events
+// must be called from the gateway's event loop after event has been applied
+func (g *Gateway) observeGroups(event Event) {
+	groups := g.groups
+	switch e := event.(type) {
+	case *CreatedMsg:
+		// new tabs join the group their window is showing
+		if name, exists := groups.active[e.WindowId]; exists && !e.Incognito {
+			groups.byTab[e.ID] = name
+		}
+	case *UpdatedMsg:
+		if _, grouped := groups.byTab[e.TabId]; !grouped || e.Delta.Url == nil {
+			return
+		}
+	case *RemovedMsg:
+		if _, grouped := groups.byTab[e.TabId]; !grouped {
+			return
+		}
+		delete(groups.byTab, e.TabId)
+	default:
+		return
+	}
+	if err := groups.save(g.tabs); err != nil {
+		log.Printf("ERROR: failed to save groups: %v", err)
+	}
+}
+
+// must be called from the gateway's event loop
+func (g *Gateway) handleGroupCall(call groupCall) {
+	request := call.request
+	info, err := g.groupRequest(request)
+	if err != nil {
+		call.responses <- &Message{Response: errorResponse(request.ID, err)}
+		return
+	}
+	call.responses <- &Message{Response: &Response{ID: request.ID, Status: "success", Info: info}}
+}
+
+func (g *Gateway) groupRequest(request *Request) (json.RawMessage, error) {
+	groups := g.groups
+	if request.Method == "listGroups" {
+		return json.Marshal(groups.list())
+	}
+	var props GroupProperties
+	if request.Props != nil {
+		// props arrive from the client as a generic map
+		data, err := json.Marshal(request.Props)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &props); err != nil {
+			return nil, err
+		}
+	}
+	windows := make(map[int]bool)
+	switch request.Method {
+	case "createGroup":
+		if props.Name == "" {
+			return nil, errors.New("A group needs a name")
+		}
+		if !groups.exists(props.Name) {
+			groups.names = append(groups.names, props.Name)
+		}
+	case "assignGroup":
+		// check every tab before changing anything, so that a bad id
+		// leaves the groups as they were
+		for _, tabId := range request.TabIds {
+			if _, exists := g.tabs.Open[tabId]; !exists {
+				return nil, fmt.Errorf("Tab with id %d not found", tabId)
+			}
+		}
+		if props.Name != "" && !groups.exists(props.Name) {
+			groups.names = append(groups.names, props.Name)
+		}
+		for _, tabId := range request.TabIds {
+			if props.Name == "" {
+				delete(groups.byTab, tabId)
+			} else {
+				groups.byTab[tabId] = props.Name
+			}
+			windows[g.tabs.Open[tabId].WindowId] = true
+		}
+	case "switchGroup":
+		if props.WindowId == 0 {
+			return nil, errors.New("switchGroup requires a windowId")
+		}
+		if props.Name == "" {
+			delete(groups.active, props.WindowId)
+		} else if !groups.exists(props.Name) {
+			return nil, fmt.Errorf("No group named %s", props.Name)
+		} else {
+			groups.active[props.WindowId] = props.Name
+		}
+		windows[props.WindowId] = true
+	case "removeGroup":
+		for i, name := range groups.names {
+			if name == props.Name {
+				groups.names = append(groups.names[:i], groups.names[i+1:]...)
+				break
+			}
+		}
+		for tabId, name := range groups.byTab {
+			if name == props.Name {
+				delete(groups.byTab, tabId)
+				if tab, exists := g.tabs.Open[tabId]; exists {
+					windows[tab.WindowId] = true
+				}
+			}
+		}
+		for windowId, name := range groups.active {
+			if name == props.Name {
+				delete(groups.active, windowId)
+				windows[windowId] = true
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Unknown group method %s", request.Method)
+	}
+	if err := groups.save(g.tabs); err != nil {
+		log.Printf("ERROR: failed to save groups: %v", err)
+	}
+	for windowId := range windows {
+		g.syncGroupVisibility(windowId)
+	}
+	return json.Marshal(groups.list())
+}
+
+// shows the tabs of the window's active group and hides the rest
+// must be called from the gateway's event loop
+func (g *Gateway) syncGroupVisibility(windowId int) {
+	showing, filtered := g.groups.active[windowId]
+	var show, hide []int
+	var activeTab, firstVisible *Tab
+	inWindow := func(tab *Tab) bool { return tab.WindowId == windowId }
+	for _, window := range g.tabs.Windows(inWindow) {
+		for _, tab := range window {
+			name := g.groups.byTab[tab.ID]
+			visible := !filtered || name == "" || name == showing || tab.Pinned
+			if tab.Active {
+				activeTab = tab
+			}
+			if visible {
+				if firstVisible == nil {
+					firstVisible = tab
+				}
+				if tab.Hidden {
+					show = append(show, tab.ID)
+				}
+			} else if !tab.Hidden {
+				hide = append(hide, tab.ID)
+			}
+		}
+	}
+	if len(show) == 0 && len(hide) == 0 {
+		return
+	}
+	// the browser won't hide the active tab, so move off it first
+	var activate *Request
+	if activeTab != nil && contains(hide, activeTab.ID) {
+		if firstVisible != nil {
+			activate = &Request{Method: "update", TabId: firstVisible.ID, Props: &UpdateProperties{Active: ptr(true)}}
+		} else {
+			activate = &Request{Method: "create", Props: &CreateProperties{WindowId: &windowId}}
+		}
+	}
+	log.Printf("Groups: window %d showing %q: show %v, hide %v", windowId, showing, show, hide)
+	// the requests must reach the browser in order, and after those of any
+	// earlier switch, but the responses arrive through the event loop, so
+	// queue them rather than wait on them here
+	description := fmt.Sprintf("switching window %d to group %q", windowId, showing)
+	var actions []action
+	if activate != nil {
+		actions = append(actions, action{description, activate})
+	}
+	if len(show) > 0 {
+		actions = append(actions, action{description, &Request{Method: "show", TabIds: show}})
+	}
+	if len(hide) > 0 {
+		actions = append(actions, action{description, &Request{Method: "hide", TabIds: hide}})
+	}
+	g.actions.push(actions...)
+}
+
+func contains(ids []int, id int) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Client methods
+
+func (client *TabsClient) ListGroups() ([]*TabGroup, error) {
+	return client.groupRequest(&Request{Method: "listGroups"})
+}
+
+func (client *TabsClient) CreateGroup(name string) ([]*TabGroup, error) {
+	return client.groupRequest(&Request{
+		Method: "createGroup",
+		Props:  &GroupProperties{Name: name},
+	})
+}
+
+// moves the tabs into the named group, creating it if needed
+// the empty name removes the tabs from their groups
+func (client *TabsClient) AssignGroup(name string, tabIds ...int) ([]*TabGroup, error) {
+	return client.groupRequest(&Request{
+		Method: "assignGroup",
+		TabIds: tabIds,
+		Props:  &GroupProperties{Name: name},
+	})
+}
+
+// shows only the named group's tabs in the window
+// the empty name shows every tab
+func (client *TabsClient) SwitchGroup(windowId int, name string) ([]*TabGroup, error) {
+	return client.groupRequest(&Request{
+		Method: "switchGroup",
+		Props:  &GroupProperties{Name: name, WindowId: windowId},
+	})
+}
+
+// deletes the group; its tabs become ungrouped and are shown
+func (client *TabsClient) RemoveGroup(name string) ([]*TabGroup, error) {
+	return client.groupRequest(&Request{
+		Method: "removeGroup",
+		Props:  &GroupProperties{Name: name},
+	})
+}
+
+func (client *TabsClient) groupRequest(request *Request) ([]*TabGroup, error) {
+	response, err := client.Request(request)
+	if err != nil {
+		return nil, err
+	} else if response.Status != "success" {
+		return nil, fmt.Errorf("Gateway responded: %s: %s", response.Status, string(response.Info))
+	}
+	var groups []*TabGroup
+	if err := json.Unmarshal(response.Info, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
@@ -0,0 +1,77 @@
+package tabs
+
+import (
+	"io"
+	"log"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testGroupGateway(t *testing.T, tabs ...*Tab) *Gateway {
+	log.SetOutput(io.Discard)
+	return &Gateway{
+		tabs:    storeOf(tabs...),
+		groups:  makeTabGroups(filepath.Join(t.TempDir(), "groups.json")),
+		actions: makeActionQueue(),
+	}
+}
+
+func TestAssignGroupChecksEveryTab(t *testing.T) {
+	g := testGroupGateway(t,
+		&Tab{ID: 1, WindowId: 1, Url: "https://example.com/"},
+		&Tab{ID: 2, WindowId: 1, Url: "https://go.dev/"},
+	)
+	request := &Request{Method: "assignGroup", TabIds: []int{1, 3, 2}, Props: &GroupProperties{Name: "work"}}
+	if _, err := g.groupRequest(request); err == nil {
+		t.Fatal("assigning a missing tab succeeded")
+	}
+	if len(g.groups.names) != 0 || len(g.groups.byTab) != 0 {
+		t.Fatalf("a failed assignGroup left groups %v and members %v", g.groups.names, g.groups.byTab)
+	}
+	if _, exists := g.actions.pop(); exists {
+		t.Fatal("a failed assignGroup queued actions")
+	}
+
+	request.TabIds = []int{1, 2}
+	if _, err := g.groupRequest(request); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int]string{1: "work", 2: "work"}
+	if !reflect.DeepEqual(g.groups.byTab, want) {
+		t.Fatalf("assignGroup left members %v, want %v", g.groups.byTab, want)
+	}
+}
+
+func TestSwitchGroupActionsStayInOrder(t *testing.T) {
+	g := testGroupGateway(t,
+		&Tab{ID: 1, WindowId: 1, Index: 0, Url: "https://example.com/", Active: true},
+		&Tab{ID: 2, WindowId: 1, Index: 1, Url: "https://go.dev/"},
+	)
+	g.groups.names = []string{"a", "b"}
+	g.groups.byTab = map[int]string{1: "a", 2: "b"}
+	switchTo := func(name string) {
+		t.Helper()
+		request := &Request{Method: "switchGroup", Props: &GroupProperties{Name: name, WindowId: 1}}
+		if _, err := g.groupRequest(request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	switchTo("b")
+	// as the browser would report it
+	g.tabs.Open[1].Hidden, g.tabs.Open[1].Active, g.tabs.Open[2].Active = true, false, true
+	switchTo("a")
+
+	var got []string
+	for {
+		next, exists := g.actions.pop()
+		if !exists {
+			break
+		}
+		got = append(got, next.request.Method)
+	}
+	want := []string{"update", "hide", "update", "show", "hide"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("queued %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,315 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	HttpApiAddr = "127.0.0.1:7073"
+	// events buffered per event stream before a slow reader misses some
+	httpEventBuffer = 64
+)
+
+// Serves a JSON API over the gateway for clients that speak plain http:
+//
+//	GET    /tabs               list the open tabs
+//	POST   /tabs               create a tab from CreateProperties
+//	GET    /tabs/{id}          one tab
+//	PATCH  /tabs/{id}          update a tab with UpdateProperties
+//	DELETE /tabs/{id}          close a tab
+//	POST   /tabs/{id}/reload   reload a tab, optionally with ReloadProperties
+//	GET    /events             Server-Sent Events, one per gateway Event
+//
+// When GatewayToken is set every request needs "Authorization: Bearer TOKEN"
+// POST and PATCH requests must be sent as "Content-Type: application/json",
+// even with an empty body, which keeps web pages from forging them with
+// plain forms. The Host header must name a loopback address, which keeps
+// pages from reaching the api by rebinding their own domain to it.
+type HttpApi struct {
+	client *TabsClient
+	// the port we listen on, which the Host header must match
+	port string
+	// guards streams
+	mu      sync.Mutex
+	streams map[chan Event]bool
+}
+
+// takes over client.Updates to feed the event streams
+func MakeHttpApi(client *TabsClient) *HttpApi {
+	api := &HttpApi{client: client, streams: make(map[chan Event]bool)}
+	go api.fanOut()
+	return api
+}
+
+func (api *HttpApi) ListenAndServe(addr string) error {
+	l, err := listenLoopback(addr)
+	if err != nil {
+		return err
+	}
+	_, api.port, _ = net.SplitHostPort(l.Addr().String())
+	log.Printf("Serving http api at http://%s", l.Addr())
+	warnNoToken("http api", addr)
+	return http.Serve(l, api)
+}
+
+func (api *HttpApi) fanOut() {
+	for event := range api.client.Updates {
+		api.mu.Lock()
+		for stream := range api.streams {
+			select {
+			case stream <- event:
+			default:
+				log.Printf("ERROR: event stream is full, dropping %s event", event.Name())
+			}
+		}
+		api.mu.Unlock()
+	}
+}
+
+// An error with the status it should be reported with
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &httpError{status: http.StatusBadRequest, err: err}
+}
+
+func notFound(err error) error {
+	return &httpError{status: http.StatusNotFound, err: err}
+}
+
+func (api *HttpApi) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowedHost(r.Host, api.port) {
+		writeJson(w, http.StatusForbidden, map[string]string{"error": fmt.Sprintf("Host %q not allowed", r.Host)})
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPatch {
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if mediaType != "application/json" {
+			writeJson(w, http.StatusUnsupportedMediaType, map[string]string{"error": "Content-Type must be application/json"})
+			return
+		}
+	}
+	if !bearerAuthorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeJson(w, http.StatusUnauthorized, map[string]string{"error": "Missing or invalid token"})
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	var err error
+	switch {
+	case len(parts) == 1 && parts[0] == "events":
+		if r.Method != http.MethodGet {
+			err = methodNotAllowed(w, http.MethodGet)
+			break
+		}
+		api.streamEvents(w, r)
+		return
+	case len(parts) == 1 && parts[0] == "tabs":
+		switch r.Method {
+		case http.MethodGet:
+			err = api.listTabs(w)
+		case http.MethodPost:
+			err = api.createTab(w, r)
+		default:
+			err = methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(parts) >= 2 && parts[0] == "tabs":
+		tabId, convErr := strconv.Atoi(parts[1])
+		if convErr != nil {
+			err = notFound(fmt.Errorf("No tab %q", parts[1]))
+			break
+		}
+		switch {
+		case len(parts) == 3 && parts[2] == "reload":
+			if r.Method != http.MethodPost {
+				err = methodNotAllowed(w, http.MethodPost)
+				break
+			}
+			err = api.reloadTab(w, r, tabId)
+		case len(parts) > 2:
+			err = notFound(errors.New("No such route"))
+		case r.Method == http.MethodGet:
+			err = api.getTab(w, tabId)
+		case r.Method == http.MethodPatch:
+			err = api.updateTab(w, r, tabId)
+		case r.Method == http.MethodDelete:
+			err = api.closeTab(w, tabId)
+		default:
+			err = methodNotAllowed(w, http.MethodGet, http.MethodPatch, http.MethodDelete)
+		}
+	default:
+		err = notFound(errors.New("No such route"))
+	}
+	if err != nil {
+		status := http.StatusBadGateway
+		var httpErr *httpError
+		var scopeErr *ScopeError
+		if errors.As(err, &httpErr) {
+			status = httpErr.status
+		} else if errors.As(err, &scopeErr) {
+			status = http.StatusForbidden
+		}
+		writeJson(w, status, map[string]string{"error": err.Error()})
+	}
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) error {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	return &httpError{status: http.StatusMethodNotAllowed, err: errors.New("Method not allowed")}
+}
+
+func (api *HttpApi) listTabs(w http.ResponseWriter) error {
+	tabs, err := api.client.GetList()
+	if err != nil {
+		return err
+	}
+	writeJson(w, http.StatusOK, tabs)
+	return nil
+}
+
+func (api *HttpApi) getTab(w http.ResponseWriter, tabId int) error {
+	tabs, err := api.client.GetList()
+	if err != nil {
+		return err
+	}
+	for _, tab := range tabs {
+		if tab.ID == tabId {
+			writeJson(w, http.StatusOK, tab)
+			return nil
+		}
+	}
+	return notFound(fmt.Errorf("Tab with id %d not found", tabId))
+}
+
+func (api *HttpApi) createTab(w http.ResponseWriter, r *http.Request) error {
+	var props CreateProperties
+	if err := readJson(w, r, &props); err != nil {
+		return err
+	}
+	tabId, err := api.client.Create(props)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Location", fmt.Sprintf("/tabs/%d", tabId))
+	writeJson(w, http.StatusCreated, map[string]int{"id": tabId})
+	return nil
+}
+
+func (api *HttpApi) updateTab(w http.ResponseWriter, r *http.Request, tabId int) error {
+	var props UpdateProperties
+	if err := readJson(w, r, &props); err != nil {
+		return err
+	}
+	if err := api.client.Update(tabId, &props); err != nil {
+		return err
+	}
+	return api.getTab(w, tabId)
+}
+
+func (api *HttpApi) closeTab(w http.ResponseWriter, tabId int) error {
+	if err := api.client.Close(tabId); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (api *HttpApi) reloadTab(w http.ResponseWriter, r *http.Request, tabId int) error {
+	var props ReloadProperties
+	if err := readJson(w, r, &props); err != nil {
+		return err
+	}
+	if err := api.client.Reload(tabId, &props); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// sends each event as it arrives until the client goes away
+func (api *HttpApi) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJson(w, http.StatusInternalServerError, map[string]string{"error": "Streaming unsupported"})
+		return
+	}
+	stream := make(chan Event, httpEventBuffer)
+	api.mu.Lock()
+	api.streams[stream] = true
+	api.mu.Unlock()
+	defer func() {
+		api.mu.Lock()
+		delete(api.streams, stream)
+		api.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-stream:
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("ERROR: marshaling %s event: %v", event.Name(), err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name(), data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// an empty body leaves v untouched
+// bodies are limited to what could be forwarded to the browser
+func readJson(w http.ResponseWriter, r *http.Request, v any) error {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(MaxBrowserMsgSize)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return &httpError{status: http.StatusRequestEntityTooLarge, err: fmt.Errorf("Request body exceeds %d bytes", tooLarge.Limit)}
+	} else if err != nil {
+		return badRequest(err)
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return badRequest(fmt.Errorf("Invalid request body: %w", err))
+	}
+	return nil
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(map[string]string{"error": err.Error()})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := w.Write(append(data, '\n')); err != nil {
+		log.Printf("ERROR: writing http response: %v", err)
+	}
+}
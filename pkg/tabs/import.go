@@ -0,0 +1,218 @@
+package tabs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// parses a tab list into a workspace, one window per group in the input
+type Importer func(r io.Reader) (*Workspace, error)
+
+var Importers = map[string]Importer{
+	"onetab":   ImportOneTab,
+	"markdown": ImportMarkdown,
+	"urls":     ImportURLs,
+	"html":     ImportHTML,
+	"json":     ImportJSON,
+}
+
+// guesses which importer understands data
+func DetectImportFormat(data []byte) string {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		return "json"
+	case bytes.Contains(bytes.ToUpper(trimmed[:minInt(len(trimmed), 512)]), []byte("NETSCAPE-BOOKMARK")),
+		bytes.Contains(bytes.ToUpper(trimmed), []byte("<DT><A ")):
+		return "html"
+	case markdownLinkRe.Match(trimmed):
+		return "markdown"
+	case oneTabLineRe.Match(trimmed):
+		return "onetab"
+	}
+	return "urls"
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// the schemes imported tabs may use; anything else, such as javascript:
+// or data:, would run or render whatever the file's author chose
+var importSchemes = map[string]bool{
+	"http":  true,
+	"https": true,
+	"ftp":   true,
+	"file":  true,
+	"about": true,
+}
+
+func isTabUrl(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil || !importSchemes[u.Scheme] {
+		return false
+	}
+	switch u.Scheme {
+	case "about":
+		return u.Opaque != ""
+	case "file":
+		return u.Path != ""
+	}
+	return u.Host != ""
+}
+
+// collects tabs into windows, skipping empty ones
+type importBuilder struct {
+	ws      *Workspace
+	current WorkspaceWindow
+}
+
+func newImportBuilder() *importBuilder {
+	return &importBuilder{ws: &Workspace{}}
+}
+
+func (b *importBuilder) add(tab WorkspaceTab) {
+	if isTabUrl(tab.Url) {
+		b.current.Tabs = append(b.current.Tabs, tab)
+	}
+}
+
+func (b *importBuilder) newWindow() {
+	if len(b.current.Tabs) > 0 {
+		b.ws.Windows = append(b.ws.Windows, b.current)
+	}
+	b.current = WorkspaceWindow{}
+}
+
+func (b *importBuilder) done(scanErr error) (*Workspace, error) {
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	b.newWindow()
+	return b.ws, nil
+}
+
+// one url per line; lines starting with # are comments
+func ImportURLs(r io.Reader) (*Workspace, error) {
+	b := newImportBuilder()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		b.add(WorkspaceTab{Url: line})
+	}
+	return b.done(scanner.Err())
+}
+
+var oneTabLineRe = regexp.MustCompile(`(?m)^\S+://\S+ \| `)
+
+// OneTab exports are "url | title" lines with blank lines between groups
+func ImportOneTab(r io.Reader) (*Workspace, error) {
+	b := newImportBuilder()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			b.newWindow()
+			continue
+		}
+		parts := strings.SplitN(line, " | ", 2)
+		title := ""
+		if len(parts) == 2 {
+			title = strings.TrimSpace(parts[1])
+		}
+		b.add(WorkspaceTab{Url: strings.TrimSpace(parts[0]), Title: title})
+	}
+	return b.done(scanner.Err())
+}
+
+var (
+	markdownLinkRe     = regexp.MustCompile(`(!?)\[((?:\\.|[^\]\\])*)\]\(<?([^)\s>]+)>?(?:\s+"[^"]*")?\)`)
+	markdownUnescapeRe = regexp.MustCompile(`\\(.)`)
+)
+
+// every link in the document; headings start a new window
+func ImportMarkdown(r io.Reader) (*Workspace, error) {
+	b := newImportBuilder()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			b.newWindow()
+		}
+		for _, match := range markdownLinkRe.FindAllStringSubmatch(line, -1) {
+			// skip images such as exported favicons
+			if match[1] == "!" {
+				continue
+			}
+			b.add(WorkspaceTab{
+				Url:   match[3],
+				Title: markdownUnescapeRe.ReplaceAllString(match[2], "$1"),
+			})
+		}
+	}
+	return b.done(scanner.Err())
+}
+
+var (
+	bookmarkFolderRe = regexp.MustCompile(`(?i)<H3[^>]*>`)
+	bookmarkLinkRe   = regexp.MustCompile(`(?is)<A\s[^>]*?HREF="([^"]*)"[^>]*>(.*?)</A>`)
+	bookmarkTokenRe  = regexp.MustCompile(`(?is)<H3[^>]*>|<A\s[^>]*?HREF="[^"]*"[^>]*>.*?</A>`)
+)
+
+// Netscape bookmark files; each folder becomes a window
+func ImportHTML(r io.Reader) (*Workspace, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b := newImportBuilder()
+	for _, token := range bookmarkTokenRe.FindAll(data, -1) {
+		if bookmarkFolderRe.Match(token) {
+			b.newWindow()
+			continue
+		}
+		match := bookmarkLinkRe.FindSubmatch(token)
+		b.add(WorkspaceTab{
+			Url:   html.UnescapeString(string(match[1])),
+			Title: html.UnescapeString(string(match[2])),
+		})
+	}
+	return b.done(nil)
+}
+
+// the schema written by ExportJSON
+func ImportJSON(r io.Reader) (*Workspace, error) {
+	var export TabExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return nil, fmt.Errorf("Failed to parse tab export: %w", err)
+	}
+	if export.Version > ExportVersion {
+		return nil, fmt.Errorf("Tab export version %d is newer than supported version %d", export.Version, ExportVersion)
+	}
+	b := newImportBuilder()
+	for _, window := range export.Windows {
+		for _, tab := range window.Tabs {
+			b.add(WorkspaceTab{
+				Url:           tab.Url,
+				Title:         tab.Title,
+				Pinned:        tab.Pinned,
+				CookieStoreId: tab.CookieStoreId,
+			})
+		}
+		b.newWindow()
+	}
+	return b.done(nil)
+}
@@ -0,0 +1,181 @@
+package tabs
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIsTabUrl(t *testing.T) {
+	tests := []struct {
+		url  string
+		want bool
+	}{
+		{"https://example.com/", true},
+		{"http://localhost:8080/a?b=c#d", true},
+		{"HTTPS://EXAMPLE.COM/", true},
+		{"ftp://ftp.gnu.org/gnu/", true},
+		{"file:///home/user/notes.html", true},
+		{"about:blank", true},
+		{"about:reader?url=https%3A%2F%2Fexample.com%2F", true},
+		{"javascript:alert(document.cookie)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg==", false},
+		{"vbscript:msgbox", false},
+		{"blob:https://example.com/0b1c9e4a", false},
+		{"place:sort=8&maxResults=10", false},
+		{"chrome://settings", false},
+		{"moz-extension://0b1c9e4a/popup.html", false},
+		{"mailto:someone@example.com", false},
+		{"https://", false},
+		{"file://", false},
+		{"about:", false},
+		{"example.com", false},
+		{"/just/a/path", false},
+		{"", false},
+		{"http://[::1", false},
+	}
+	for _, test := range tests {
+		if got := isTabUrl(test.url); got != test.want {
+			t.Errorf("isTabUrl(%q) = %v, want %v", test.url, got, test.want)
+		}
+	}
+}
+
+func TestImporters(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		want   []WorkspaceWindow
+	}{
+		{
+			name:   "onetab",
+			format: "onetab",
+			input: `https://github.com/golang/go/issues | Issues · golang/go · GitHub
+https://pkg.go.dev/net/url | url package - net/url - Go Packages
+javascript:void(0) | Bookmarklet
+
+https://en.wikipedia.org/wiki/Favicon | Favicon - Wikipedia
+https://example.com/search?q=a|b | a | b - Example Search
+data:text/html,<h1>hi</h1> | Data
+about:blank | New Tab
+
+javascript:alert(1) | Nothing else in this group
+`,
+			want: []WorkspaceWindow{
+				{Tabs: []WorkspaceTab{
+					{Url: "https://github.com/golang/go/issues", Title: "Issues · golang/go · GitHub"},
+					{Url: "https://pkg.go.dev/net/url", Title: "url package - net/url - Go Packages"},
+				}},
+				{Tabs: []WorkspaceTab{
+					{Url: "https://en.wikipedia.org/wiki/Favicon", Title: "Favicon - Wikipedia"},
+					{Url: "https://example.com/search?q=a|b", Title: "a | b - Example Search"},
+					{Url: "about:blank", Title: "New Tab"},
+				}},
+			},
+		},
+		{
+			name:   "markdown",
+			format: "markdown",
+			input: `## Window 1
+
+- ![](file:///home/user/.cache/tabs_server/favicons/1234.png) [The Go \[Programming\] Language](https://go.dev/)
+- [Example](<https://example.com/a b>)
+- [Example Domain](https://example.com/ "Example")
+
+## Window 2
+
+- [Click me](javascript:alert(1))
+- [Inline](data:text/plain,hello)
+- [Notes](file:///home/user/notes.html)
+- See [the FAQ](https://go.dev/doc/faq) and [the spec](https://go.dev/ref/spec).
+`,
+			want: []WorkspaceWindow{
+				{Tabs: []WorkspaceTab{
+					{Url: "https://go.dev/", Title: "The Go [Programming] Language"},
+					{Url: "https://example.com/", Title: "Example Domain"},
+				}},
+				{Tabs: []WorkspaceTab{
+					{Url: "file:///home/user/notes.html", Title: "Notes"},
+					{Url: "https://go.dev/doc/faq", Title: "the FAQ"},
+					{Url: "https://go.dev/ref/spec", Title: "the spec"},
+				}},
+			},
+		},
+		{
+			// as exported by Firefox
+			name:   "bookmark html",
+			format: "html",
+			input: `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<meta http-equiv="Content-Security-Policy"
+      content="default-src 'self'; script-src 'none'; img-src data: *; object-src 'none'"></meta>
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks Menu</H1>
+
+<DL><p>
+    <DT><H3 ADD_DATE="1650000000" LAST_MODIFIED="1650000100">Mozilla Firefox</H3>
+    <DL><p>
+        <DT><A HREF="https://support.mozilla.org/en-US/products/firefox" ADD_DATE="1650000000" LAST_MODIFIED="1650000000" ICON_URI="https://support.mozilla.org/static/img/favicon.ico" ICON="data:image/png;base64,iVBORw0KGgo=">Get Help</A>
+        <DT><A HREF="https://www.mozilla.org/en-US/firefox/customize/" ADD_DATE="1650000000" LAST_MODIFIED="1650000000">Customize Firefox</A>
+    </DL><p>
+    <DT><A HREF="javascript:(function(){alert(document.title)})()" ADD_DATE="1650000200" LAST_MODIFIED="1650000200">Show title</A>
+    <DT><A HREF="place:sort=8&amp;maxResults=10" ADD_DATE="1650000300" LAST_MODIFIED="1650000300">Recent Tags</A>
+    <DT><H3 ADD_DATE="1650000400" LAST_MODIFIED="1650000500" PERSONAL_TOOLBAR_FOLDER="true">Bookmarks Toolbar</H3>
+    <DL><p>
+        <DT><A HREF="https://go.dev/doc/" ADD_DATE="1650000400" LAST_MODIFIED="1650000400">Documentation - The Go Programming Language</A>
+        <DT><A HREF="https://news.ycombinator.com/item?id=1&amp;p=2" ADD_DATE="1650000400">Hacker News &amp; friends</A>
+        <DT><A HREF="data:text/html,&lt;script&gt;alert(1)&lt;/script&gt;" ADD_DATE="1650000400">Data</A>
+        <DT><A HREF="file:///home/user/notes.html" ADD_DATE="1650000400">Notes</A>
+    </DL><p>
+</DL>
+`,
+			want: []WorkspaceWindow{
+				{Tabs: []WorkspaceTab{
+					{Url: "https://support.mozilla.org/en-US/products/firefox", Title: "Get Help"},
+					{Url: "https://www.mozilla.org/en-US/firefox/customize/", Title: "Customize Firefox"},
+				}},
+				{Tabs: []WorkspaceTab{
+					{Url: "https://go.dev/doc/", Title: "Documentation - The Go Programming Language"},
+					{Url: "https://news.ycombinator.com/item?id=1&p=2", Title: "Hacker News & friends"},
+					{Url: "file:///home/user/notes.html", Title: "Notes"},
+				}},
+			},
+		},
+		{
+			name:   "urls",
+			format: "urls",
+			input: `# reading list
+https://go.dev/blog/
+javascript:alert(1)
+
+ftp://ftp.gnu.org/gnu/
+`,
+			want: []WorkspaceWindow{
+				{Tabs: []WorkspaceTab{
+					{Url: "https://go.dev/blog/"},
+					{Url: "ftp://ftp.gnu.org/gnu/"},
+				}},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := DetectImportFormat([]byte(test.input)); got != test.format {
+				t.Errorf("detected %s, want %s", got, test.format)
+			}
+			ws, err := Importers[test.format](strings.NewReader(test.input))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ws.Windows, test.want) {
+				t.Fatalf("got windows\n%+v\nwant\n%+v", ws.Windows, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,317 @@
+package tabs
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+var (
+	// address for accepting JSON-RPC 2.0 clients; a path starting with /
+	// is a unix socket, anything else a loopback tcp address
+	// empty disables the listener
+	GatewayJsonRpcAddr = ""
+)
+
+// JSON-RPC error codes
+const (
+	jsonRpcParseError     = -32700
+	jsonRpcInvalidRequest = -32600
+	jsonRpcInvalidParams  = -32602
+	// the browser or gateway failed to carry out the request
+	jsonRpcRequestFailed = -32000
+	// the client's profile doesn't allow the method; data is a ScopeError
+	jsonRpcDenied = -32001
+)
+
+type jsonRpcRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method"`
+	// named parameters, laid out like Request: tabId, tabIds, props etc
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type jsonRpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type jsonRpcResponse struct {
+	JsonRpc string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *jsonRpcError   `json:"error,omitempty"`
+}
+
+// Events are sent as notifications named after the event
+type jsonRpcNotification struct {
+	JsonRpc string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  Event  `json:"params"`
+}
+
+// A client speaking JSON-RPC 2.0, framed either one message per line or
+// with LSP style Content-Length headers; which is decided by the first
+// thing the client sends and used in both directions
+type jsonRpcConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	// whether messages are framed with headers rather than newlines;
+	// only set by the reader
+	headers bool
+	// guards writes, ids and setting headers
+	mu sync.Mutex
+	// the client's id for each request in flight; notifications have none
+	ids map[uuid.UUID]json.RawMessage
+}
+
+func makeJsonRpcConn(conn net.Conn) *jsonRpcConn {
+	return &jsonRpcConn{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+		ids:    make(map[uuid.UUID]json.RawMessage),
+	}
+}
+
+func (c *jsonRpcConn) ReadMsg() (*Message, error) {
+	for {
+		data, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimSpace(data)
+		if len(data) == 0 {
+			continue
+		}
+		if !json.Valid(data) {
+			c.sendError(nil, jsonRpcParseError, "invalid JSON")
+			continue
+		}
+		// a batch is answered as a whole, which the one response per
+		// request the gateway gives us can't do
+		if data[0] == '[' {
+			c.sendError(nil, jsonRpcInvalidRequest, "batch requests are not supported")
+			continue
+		}
+		var rpc jsonRpcRequest
+		if err := json.Unmarshal(data, &rpc); err != nil {
+			c.sendError(nil, jsonRpcInvalidRequest, "expected a JSON-RPC 2.0 request object")
+			continue
+		}
+		if rpc.JsonRpc != "2.0" || rpc.Method == "" {
+			c.sendError(rpc.ID, jsonRpcInvalidRequest, "expected a JSON-RPC 2.0 request")
+			continue
+		}
+		request := &Request{}
+		if len(rpc.Params) > 0 && !bytes.Equal(rpc.Params, []byte("null")) {
+			if err := json.Unmarshal(rpc.Params, request); err != nil {
+				c.sendError(rpc.ID, jsonRpcInvalidParams, "params must be an object like {tabId, tabIds, props}")
+				continue
+			}
+		}
+		request.ID = uuid.New()
+		request.Method = rpc.Method
+		if rpc.ID != nil {
+			c.mu.Lock()
+			c.ids[request.ID] = rpc.ID
+			c.mu.Unlock()
+		}
+		return &Message{Request: request}, nil
+	}
+}
+
+// returns the next message body
+func (c *jsonRpcConn) readFrame() ([]byte, error) {
+	if !c.headers {
+		// skip blank lines between messages so that they can't be
+		// mistaken for the start of a header block
+		for {
+			b, err := c.reader.Peek(1)
+			if err != nil {
+				return nil, err
+			}
+			if b[0] != '\n' && b[0] != '\r' && b[0] != ' ' && b[0] != '\t' {
+				break
+			}
+			c.reader.ReadByte()
+		}
+		// JSON never starts with a c, so only then wait for enough to tell
+		// whether this is a header; a short message may be all there is
+		var peek []byte
+		if first, _ := c.reader.Peek(1); first[0] == 'c' || first[0] == 'C' {
+			peek, _ = c.reader.Peek(len("content-length"))
+		}
+		if !strings.EqualFold(string(peek), "content-length") {
+			line, err := c.readLine()
+			if err == io.EOF && len(line) > 0 {
+				// the last message needn't end in a newline
+				return line, nil
+			}
+			return line, err
+		}
+		c.mu.Lock()
+		c.headers = true
+		c.mu.Unlock()
+	}
+	size := -1
+	for {
+		data, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		line := strings.TrimRight(string(data), "\r\n")
+		if line == "" {
+			break
+		}
+		name, value, found := strings.Cut(line, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), "content-length") {
+			if size, err = strconv.Atoi(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("ERROR: bad Content-Length %q", value)
+			}
+		}
+	}
+	if size < 0 {
+		return nil, errors.New("ERROR: message has no Content-Length")
+	}
+	if size > MaxBrowserMsgSize {
+		return nil, fmt.Errorf("ERROR: msg of %d bytes exceeds limit of %d: %w", size, MaxBrowserMsgSize, ErrMsgTooLarge)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.reader, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// reads up to and including the next newline, giving up once the line is
+// longer than any message could be
+func (c *jsonRpcConn) readLine() ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > MaxBrowserMsgSize {
+			return nil, fmt.Errorf("ERROR: msg exceeds limit of %d bytes: %w", MaxBrowserMsgSize, ErrMsgTooLarge)
+		}
+		if err != bufio.ErrBufferFull {
+			return line, err
+		}
+	}
+}
+
+func (c *jsonRpcConn) SendMsg(msg *Message) error {
+	switch {
+	case msg.Response != nil:
+		response := msg.Response
+		c.mu.Lock()
+		id, exists := c.ids[response.ID]
+		delete(c.ids, response.ID)
+		c.mu.Unlock()
+		if !exists {
+			// a notification; the client wants no reply
+			return nil
+		}
+		if response.Status == "denied" {
+			return c.send(&jsonRpcResponse{
+				JsonRpc: "2.0",
+				ID:      id,
+				Error:   &jsonRpcError{Code: jsonRpcDenied, Message: "permission denied", Data: response.Info},
+			})
+		}
+		if response.Status == "error" {
+			message := string(response.Info)
+			var text string
+			if json.Unmarshal(response.Info, &text) == nil {
+				message = text
+			}
+			return c.sendError(id, jsonRpcRequestFailed, message)
+		}
+		result := response.Info
+		if len(result) == 0 {
+			result = json.RawMessage("null")
+		}
+		return c.send(&jsonRpcResponse{JsonRpc: "2.0", ID: id, Result: result})
+	case msg.Event != nil:
+		return c.send(&jsonRpcNotification{JsonRpc: "2.0", Method: msg.Event.Name(), Params: msg.Event})
+	}
+	return nil
+}
+
+func (c *jsonRpcConn) sendError(id json.RawMessage, code int, message string) error {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return c.send(&jsonRpcResponse{
+		JsonRpc: "2.0",
+		ID:      id,
+		Error:   &jsonRpcError{Code: code, Message: message},
+	})
+}
+
+func (c *jsonRpcConn) send(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.headers {
+		data = append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))), data...)
+	} else {
+		data = append(data, '\n')
+	}
+	_, err = c.conn.Write(data)
+	return err
+}
+
+func (c *jsonRpcConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *jsonRpcConn) String() string {
+	return fmt.Sprintf("jsonrpc %s %s", c.conn.LocalAddr().Network(), c.conn.RemoteAddr())
+}
+
+// accepts JSON-RPC clients until the listener fails
+func (g *Gateway) listenJsonRpc(addr string) error {
+	var l net.Listener
+	var err error
+	unix := strings.HasPrefix(addr, "/")
+	if unix {
+		l, err = listenUnix(addr)
+	} else {
+		l, err = listenLoopback(addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	log.Printf("Accepting JSON-RPC clients at %s", addr)
+	if !unix {
+		warnNoToken("JSON-RPC listener", addr)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if err := checkPeer(conn); err != nil {
+			log.Printf("ERROR: refusing client: %v", err)
+			conn.Close()
+			continue
+		}
+		g.addConn(makeJsonRpcConn(conn), !unix)
+	}
+}
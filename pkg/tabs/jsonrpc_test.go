@@ -0,0 +1,102 @@
+package tabs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+// a jsonRpcConn reading what the returned client end writes
+func testJsonRpcConn(t *testing.T) (*jsonRpcConn, net.Conn, *bufio.Reader) {
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return makeJsonRpcConn(server), client, bufio.NewReader(client)
+}
+
+func TestJsonRpcRejectsBadRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		code  int
+	}{
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"list"},{"jsonrpc":"2.0","id":2,"method":"list"}]`, jsonRpcInvalidRequest},
+		{"empty batch", `[]`, jsonRpcInvalidRequest},
+		{"batch of notifications", ` [{"jsonrpc":"2.0","method":"list"}]`, jsonRpcInvalidRequest},
+		{"not json", `{"jsonrpc":"2.0",`, jsonRpcParseError},
+		{"not an object", `5`, jsonRpcInvalidRequest},
+		{"wrong field type", `{"jsonrpc":"2.0","id":1,"method":5}`, jsonRpcInvalidRequest},
+		{"wrong version", `{"jsonrpc":"1.0","id":1,"method":"list"}`, jsonRpcInvalidRequest},
+		{"no method", `{"jsonrpc":"2.0","id":1}`, jsonRpcInvalidRequest},
+		{"bad params", `{"jsonrpc":"2.0","id":1,"method":"list","params":[1]}`, jsonRpcInvalidParams},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, client, responses := testJsonRpcConn(t)
+			msgs := make(chan *Message, 1)
+			go func() {
+				if msg, err := conn.ReadMsg(); err == nil {
+					msgs <- msg
+				}
+			}()
+			if _, err := client.Write([]byte(test.input + "\n")); err != nil {
+				t.Fatal(err)
+			}
+			line, err := responses.ReadBytes('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			var response jsonRpcResponse
+			if err := json.Unmarshal(line, &response); err != nil {
+				t.Fatalf("unmarshaling %s: %v", line, err)
+			}
+			if response.Error == nil || response.Error.Code != test.code {
+				t.Fatalf("got %s, want error %d", line, test.code)
+			}
+
+			// the connection carries on with the next request
+			if _, err := client.Write([]byte(`{"jsonrpc":"2.0","id":"next","method":"list"}` + "\n")); err != nil {
+				t.Fatal(err)
+			}
+			msg := <-msgs
+			if msg.Request == nil || msg.Request.Method != "list" {
+				t.Fatalf("read %v after a bad request, want the list request", msg)
+			}
+		})
+	}
+}
+
+func TestJsonRpcRejectsBatchWithHeaders(t *testing.T) {
+	conn, client, responses := testJsonRpcConn(t)
+	go conn.ReadMsg()
+	if _, err := client.Write([]byte("Content-Length: 2\r\n\r\n[]")); err != nil {
+		t.Fatal(err)
+	}
+	header, err := responses.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var size int
+	if _, err := fmt.Sscanf(header, "Content-Length: %d\r\n", &size); err != nil {
+		t.Fatalf("got header %q: %v", header, err)
+	}
+	if blank, _ := responses.ReadString('\n'); blank != "\r\n" {
+		t.Fatalf("got %q after the header, want a blank line", blank)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(responses, body); err != nil {
+		t.Fatal(err)
+	}
+	var response jsonRpcResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Fatalf("unmarshaling %s: %v", body, err)
+	}
+	if response.Error == nil || response.Error.Code != jsonRpcInvalidRequest || string(response.ID) != "null" {
+		t.Fatalf("got %s, want an invalid request error with a null id", body)
+	}
+}
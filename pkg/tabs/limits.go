@@ -0,0 +1,161 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+var (
+	LimitsFile = filepath.Join(configDir(), "limits.json")
+)
+
+// how long to wait for the browser to carry out an automatic action
+// (rules, limits) before trying it again
+const pendingActionTimeout = 30 * time.Second
+
+// Caps on the number of open tabs, checked whenever a tab is created
+// A limit of 0 means no limit
+type TabLimits struct {
+	PerWindow int `json:"perWindow"`
+	Global    int `json:"global"`
+	// what to do with the least recently used unpinned tab once a limit
+	// is exceeded: close, discard, archive or warn
+	Policy string `json:"policy"`
+	// workspace that archived tabs are saved to before being closed
+	ArchiveWorkspace string `json:"archiveWorkspace"`
+}
+
+func LoadLimits(filename string) (*TabLimits, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	limits := &TabLimits{Policy: "warn", ArchiveWorkspace: "archive"}
+	if err := json.Unmarshal(data, limits); err != nil {
+		return nil, fmt.Errorf("Failed to parse limits: %w", err)
+	}
+	switch limits.Policy {
+	case "close", "discard", "archive", "warn":
+	default:
+		return nil, fmt.Errorf("unknown limit policy %q", limits.Policy)
+	}
+	return limits, nil
+}
+
+// Sent to clients when a limit is exceeded under the warn policy
+type LimitMsg struct {
+	// "window" or "global"
+	Scope    string `json:"scope"`
+	WindowId int    `json:"windowId,omitempty"`
+	Count    int    `json:"count"`
+	Limit    int    `json:"limit"`
+}
+
+func (_ *LimitMsg) Name() string {
+	return "limitExceeded"
+}
+
+func (_ *LimitMsg) Apply(_ *TabStore) error {
+	return nil
+}
+
+// checks the limits after tab has been created and applies the policy
+// must be called from the gateway's event loop
+func (g *Gateway) enforceLimits(created *Tab) {
+	limits := g.limits
+	if limits == nil || created.Incognito {
+		return
+	}
+	// discarding doesn't reduce the number of tabs, only loaded ones
+	counts := func(tab *Tab) bool {
+		return !tab.Incognito && !(limits.Policy == "discard" && tab.Discarded)
+	}
+	var inWindow, all []*Tab
+	for _, tab := range g.tabs.Open {
+		if !counts(tab) {
+			continue
+		}
+		all = append(all, tab)
+		if tab.WindowId == created.WindowId {
+			inWindow = append(inWindow, tab)
+		}
+	}
+
+	now := time.Now()
+	g.expireActions(now)
+	if limits.PerWindow > 0 && len(inWindow) > limits.PerWindow {
+		g.overflow(&LimitMsg{Scope: "window", WindowId: created.WindowId, Count: len(inWindow), Limit: limits.PerWindow},
+			inWindow, created, now)
+	}
+	if limits.Global > 0 && len(all) > limits.Global {
+		g.overflow(&LimitMsg{Scope: "global", Count: len(all), Limit: limits.Global},
+			all, created, now)
+	}
+}
+
+func (g *Gateway) overflow(exceeded *LimitMsg, tabs []*Tab, created *Tab, now time.Time) {
+	log.Printf("Tab limit exceeded: %d %s tabs, limit %d", exceeded.Count, exceeded.Scope, exceeded.Limit)
+	if g.limits.Policy == "warn" {
+		g.broadcast(&Message{Event: exceeded})
+		return
+	}
+	// least recently used first
+	sort.Slice(tabs, func(i, j int) bool { return tabs[i].LastAccessed < tabs[j].LastAccessed })
+	excess := exceeded.Count - exceeded.Limit
+	for _, tab := range tabs {
+		if excess == 0 {
+			break
+		}
+		if tab.ID == created.ID || tab.Pinned || tab.Active {
+			continue
+		}
+		if !g.startAction(fmt.Sprintf("limit/%d", tab.ID), now) {
+			// already on its way out
+			excess--
+			continue
+		}
+		excess--
+		log.Printf("Limit: %s tab %d (%s)", g.limits.Policy, tab.ID, loggedUrl(tab))
+		description := fmt.Sprintf("limit %s on tab %d", g.limits.Policy, tab.ID)
+		switch g.limits.Policy {
+		case "discard":
+			go g.act(description, &Request{Method: "discard", TabIds: []int{tab.ID}})
+		case "archive":
+			if err := archiveTab(g.limits.ArchiveWorkspace, tab); err != nil {
+				log.Printf("ERROR: failed to archive tab %d: %v", tab.ID, err)
+				continue
+			}
+			fallthrough
+		case "close":
+			go g.act(description, &Request{Method: "remove", TabIds: []int{tab.ID}})
+		}
+	}
+}
+
+// appends the tab to the named workspace, creating it if needed
+func archiveTab(name string, tab *Tab) error {
+	ws, err := LoadWorkspace(name)
+	if errors.Is(err, os.ErrNotExist) {
+		ws = &Workspace{Name: name}
+	} else if err != nil {
+		return err
+	}
+	if len(ws.Windows) == 0 {
+		ws.Windows = []WorkspaceWindow{{}}
+	}
+	ws.Windows[0].Tabs = append(ws.Windows[0].Tabs, WorkspaceTab{
+		Url:           tab.Url,
+		Title:         tab.Title,
+		CookieStoreId: tab.CookieStoreId,
+	})
+	ws.Saved = time.Now()
+	return SaveWorkspace(ws)
+}
@@ -3,6 +3,7 @@ package tabs
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -16,12 +17,27 @@ type Response struct {
 	Info   json.RawMessage `json:"info,omitempty"`
 }
 
+// describes the response without its info, which may be private
+func (r *Response) String() string {
+	if r == nil {
+		return "no response"
+	}
+	return fmt.Sprintf("response %s %s", r.Status, r.ID)
+}
+
 type Request struct {
 	ID     uuid.UUID `json:"id"`
 	Method string    `json:"method"`
 	TabId  int       `json:"tabId,omitempty"`
 	TabIds []int     `json:"tabIds,omitempty"`
-	Props  any       `json:"props,omitempty"`
+	// for container methods
+	CookieStoreId string `json:"cookieStoreId,omitempty"`
+	// for download methods
+	DownloadId int `json:"downloadId,omitempty"`
+	// for authenticate
+	Profile string `json:"profile,omitempty"`
+	Token   string `json:"token,omitempty"`
+	Props   any    `json:"props,omitempty"`
 }
 
 type rawMessage struct {
@@ -35,6 +51,19 @@ type Message struct {
 	Event    Event
 }
 
+// describes the message without its contents, which may be private
+func (msg *Message) String() string {
+	switch {
+	case msg.Request != nil:
+		return fmt.Sprintf("request %s %s", msg.Request.Method, msg.Request.ID)
+	case msg.Response != nil:
+		return msg.Response.String()
+	case msg.Event != nil:
+		return fmt.Sprintf("event %s", msg.Event.Name())
+	}
+	return "empty message"
+}
+
 func (msg *Message) MarshalJSON() ([]byte, error) {
 	var msgType string
 	var content any
@@ -47,7 +76,6 @@ func (msg *Message) MarshalJSON() ([]byte, error) {
 		content = msg.Response
 	case msg.Event != nil:
 		msgType = "event"
-		log.Printf("Marshaling event: %v", msg.Event)
 		eventBytes, err := json.Marshal(msg.Event)
 		if err != nil {
 			return nil, err
@@ -92,14 +120,32 @@ func (msg *Message) UnmarshalJSON(data []byte) error {
 			event = &MovedMsg{}
 		case "attached", "detached":
 			event = &AttachedMsg{}
+		case "limitExceeded":
+			event = &LimitMsg{}
+		case "containerCreated":
+			event = &ContainerMsg{Change: "created"}
+		case "containerUpdated":
+			event = &ContainerMsg{Change: "updated"}
+		case "containerRemoved":
+			event = &ContainerMsg{Change: "removed"}
+		case "downloadCreated":
+			event = &DownloadCreatedMsg{}
+		case "downloadChanged":
+			event = &DownloadChangedMsg{}
+		case "downloadProgress":
+			event = &DownloadProgressMsg{}
+		case "downloadErased":
+			event = &DownloadErasedMsg{}
+		case "focusChanged":
+			event = &FocusChangedMsg{}
+		case "idleStateChanged":
+			event = &IdleStateMsg{}
 		default:
 			return fmt.Errorf("Event of unknown type: %s", rawEvent.Type)
 		}
-		log.Printf("Unmarshaling to event: %s", string(raw.Data))
 		if err := json.Unmarshal(rawEvent.Data, &event); err != nil {
 			return err
 		}
-		log.Printf("Unmarshalled to: %v", event)
 		msg.Event = event
 		return nil
 	default:
@@ -107,7 +153,46 @@ func (msg *Message) UnmarshalJSON(data []byte) error {
 	}
 }
 
+var (
+	// the largest message Firefox accepts from us; anything a client sends
+	// is forwarded to the browser, so this also limits clients' messages
+	MaxBrowserMsgSize = 1 << 20
+	// the largest message we read from the browser, or from the gateway;
+	// Firefox allows up to 4 GiB, but nothing we ask for comes near this
+	MaxMsgSize = 64 << 20
+)
+
+var ErrMsgTooLarge = errors.New("message too large")
+
+// A message that was read, or skipped, whole but could not be used
+// the stream is still positioned at the start of the next message, so
+// the reader may carry on; any other error from ReadMsg leaves it lost
+type BadMsgError struct {
+	Err error
+}
+
+func (e *BadMsgError) Error() string {
+	return fmt.Sprintf("ERROR: bad msg: %v", e.Err)
+}
+
+func (e *BadMsgError) Unwrap() error {
+	return e.Err
+}
+
+// whether err from ReadMsg leaves the stream usable
+func recoverableMsgError(err error) bool {
+	var bad *BadMsgError
+	return errors.As(err, &bad)
+}
+
 func ReadMsg(r io.Reader) (*Message, error) {
+	return readMsgLimit(r, MaxMsgSize)
+}
+
+// reads a message, skipping over any larger than limit bytes
+// memory is only allocated as the body arrives, so a size that the body
+// doesn't live up to costs nothing
+func readMsgLimit(r io.Reader, limit int) (*Message, error) {
 	buf := make([]byte, 4)
 	_, err := io.ReadFull(r, buf)
 	if err == io.EOF {
@@ -115,29 +200,47 @@ func ReadMsg(r io.Reader) (*Message, error) {
 	} else if err != nil {
 		return nil, fmt.Errorf("ERROR: reading msg size: %v", err)
 	}
-	msgSize := int(binary.LittleEndian.Uint32(buf))
-	buf = append(buf, make([]byte, msgSize)...)
-	_, err = io.ReadFull(r, buf[4:])
-	if err == io.EOF {
-		return nil, err
-	} else if err != nil {
-		return nil, fmt.Errorf("ERROR: reading msg: %v", err)
+	msgSize := int64(binary.LittleEndian.Uint32(buf))
+	if msgSize > int64(limit) {
+		tooLarge := fmt.Errorf("msg of %d bytes exceeds limit of %d: %w", msgSize, limit, ErrMsgTooLarge)
+		if _, err := io.CopyN(io.Discard, r, msgSize); err != nil {
+			return nil, fmt.Errorf("ERROR: skipping %w: %v", tooLarge, err)
+		}
+		return nil, &BadMsgError{Err: tooLarge}
+	}
+	buf, err = io.ReadAll(io.LimitReader(r, msgSize))
+	if err == nil && int64(len(buf)) < msgSize {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		// the size was promised, so running out now is not a clean EOF
+		return nil, fmt.Errorf("ERROR: reading msg: %w", err)
 	}
 	msg := &Message{}
-	if err := json.Unmarshal(buf[4:], msg); err != nil {
-		log.Println(err)
-		return nil, err
+	if err := json.Unmarshal(buf, msg); err != nil {
+		return nil, &BadMsgError{Err: err}
+	}
+	if msg.Request == nil && msg.Response == nil && msg.Event == nil {
+		return nil, &BadMsgError{Err: errors.New("message has no content")}
 	}
 	log.Println("RECEIVED:", msg)
 	return msg, nil
 }
 
 func SendMsg(w io.Writer, msg *Message) error {
+	return sendMsgLimit(w, msg, MaxMsgSize)
+}
+
+// writes a message, refusing any larger than limit bytes
+func sendMsgLimit(w io.Writer, msg *Message, limit int) error {
 	// add size if not already there
 	buf, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
+	if len(buf) > limit {
+		return fmt.Errorf("ERROR: msg of %d bytes exceeds limit of %d: %w", len(buf), limit, ErrMsgTooLarge)
+	}
 	size := make([]byte, 4)
 	binary.LittleEndian.PutUint32(size, uint32(len(buf)))
 	buf = append(size, buf...)
@@ -0,0 +1,144 @@
+package tabs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"runtime"
+	"testing"
+)
+
+// prefixes data with its length, as the browser does
+func frame(data []byte) []byte {
+	size := make([]byte, 4)
+	binary.LittleEndian.PutUint32(size, uint32(len(data)))
+	return append(size, data...)
+}
+
+// a frame that claims size bytes and carries body, however long it is
+func frameOfSize(size uint32, body []byte) []byte {
+	prefix := make([]byte, 4)
+	binary.LittleEndian.PutUint32(prefix, size)
+	return append(prefix, body...)
+}
+
+var (
+	testRequest  = []byte(`{"type":"request","data":{"id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","method":"list","tabId":3}}`)
+	testResponse = []byte(`{"type":"response","data":{"id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8","status":"success","info":[1,2]}}`)
+	testEvent    = []byte(`{"type":"event","data":{"type":"updated","data":{"tabId":1,"delta":{"title":"x"}}}}`)
+)
+
+func FuzzReadMsg(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Add(frame(testRequest))
+	f.Add(frame(testEvent))
+	f.Add(append(frame(testResponse), frame(testRequest)...))
+	// truncated
+	f.Add(frame(testRequest)[:20])
+	f.Add([]byte{1, 0})
+	// oversized length prefix
+	f.Add(frameOfSize(0xffffffff, testRequest))
+	f.Add(frameOfSize(uint32(MaxMsgSize)+1, nil))
+	// empty message
+	f.Add(frame(nil))
+	f.Add(frame([]byte("{}")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var size int64 = -1
+		if len(data) >= 4 {
+			size = int64(binary.LittleEndian.Uint32(data))
+		}
+		r := bytes.NewReader(data)
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		msg, err := ReadMsg(r)
+		runtime.ReadMemStats(&after)
+
+		// whatever the prefix claims, memory follows what actually arrived
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20+64*uint64(len(data)) {
+			t.Fatalf("allocated %d bytes reading %d", allocated, len(data))
+		}
+		body := int64(len(data)) - 4
+		switch {
+		case len(data) == 0:
+			if err != io.EOF {
+				t.Fatalf("got %v from no input, want io.EOF", err)
+			}
+		case size < 0:
+			if err == nil || err == io.EOF || recoverableMsgError(err) {
+				t.Fatalf("got %v from a partial size, want a fatal error", err)
+			}
+		case size > int64(MaxMsgSize):
+			if !errors.Is(err, ErrMsgTooLarge) {
+				t.Fatalf("got %v for a %d byte frame, want ErrMsgTooLarge", err, size)
+			}
+			if recoverableMsgError(err) != (body >= size) {
+				t.Fatalf("got %v for a %d byte frame with %d bytes", err, size, body)
+			}
+		case body < size:
+			if err == nil || recoverableMsgError(err) {
+				t.Fatalf("got %v from a truncated frame, want a fatal error", err)
+			}
+		case err == nil:
+			if msg.Request == nil && msg.Response == nil && msg.Event == nil {
+				t.Fatal("got an empty message without an error")
+			}
+		default:
+			if !recoverableMsgError(err) {
+				t.Fatalf("got %v from a whole frame, want a BadMsgError", err)
+			}
+		}
+		// a whole frame, used or not, leaves the reader at the next one
+		if (err == nil || recoverableMsgError(err)) && int64(r.Len()) != body-size {
+			t.Fatalf("reader has %d bytes left, want %d", r.Len(), body-size)
+		}
+	})
+}
+
+func FuzzMessageUnmarshalJSON(f *testing.F) {
+	log.SetOutput(io.Discard)
+	f.Add(testRequest)
+	f.Add(testResponse)
+	f.Add(testEvent)
+	f.Add([]byte(`{"type":"event","data":{"type":"created","data":{"id":4,"incognito":true}}}`))
+	f.Add([]byte(`{"type":"event","data":{"type":"downloadChanged","data":{"id":2,"state":{"previous":"in_progress","current":"complete"}}}}`))
+	f.Add([]byte(`{"type":"event","data":{"type":"removed","data":null}}`))
+	f.Add([]byte(`{"type":"request","data":null}`))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`null`))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := &Message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			return
+		}
+		if msg.Request == nil && msg.Response == nil && msg.Event == nil {
+			return
+		}
+		// whatever we accept, we can send on
+		encoded, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("marshaling %s: %v", data, err)
+		}
+		if err := json.Unmarshal(encoded, &Message{}); err != nil {
+			t.Fatalf("unmarshaling our own %s: %v", encoded, err)
+		}
+	})
+}
+
+func TestReadMsgSkipsOversized(t *testing.T) {
+	log.SetOutput(io.Discard)
+	oversized := frame(bytes.Repeat([]byte("x"), 100))
+	r := bytes.NewReader(append(oversized, frame(testRequest)...))
+	if _, err := readMsgLimit(r, 64); !errors.Is(err, ErrMsgTooLarge) || !recoverableMsgError(err) {
+		t.Fatalf("got %v for an oversized frame, want a recoverable ErrMsgTooLarge", err)
+	}
+	msg, err := readMsgLimit(r, len(testRequest))
+	if err != nil {
+		t.Fatalf("reading the frame after an oversized one: %v", err)
+	}
+	if msg.Request == nil || msg.Request.Method != "list" {
+		t.Fatalf("got %v after an oversized frame, want the list request", msg)
+	}
+}
@@ -0,0 +1,71 @@
+package tabs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// where persistent state is kept: $XDG_DATA_HOME/tabs_server
+func dataDir() string {
+	return xdgDir("XDG_DATA_HOME", ".local", "share")
+}
+
+// where sockets are created: $XDG_RUNTIME_DIR/tabs_server, or a per-user
+// directory in the temp dir on systems without one
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tabs_server")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tabs_server-%d", os.Getuid()))
+}
+
+// where caches are kept: the user cache dir (e.g. $XDG_CACHE_HOME) plus
+// tabs_server, or a per-user directory in the temp dir on systems without one
+func cacheDir() string {
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "tabs_server")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tabs_server-cache-%d", os.Getuid()))
+}
+
+// where user configuration is read from: $XDG_CONFIG_HOME/tabs_server
+func configDir() string {
+	return xdgDir("XDG_CONFIG_HOME", ".config")
+}
+
+func xdgDir(env string, fallback ...string) string {
+	if dir := os.Getenv(env); dir != "" {
+		return filepath.Join(dir, "tabs_server")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return filepath.Join(os.TempDir(), "tabs_server")
+	}
+	return filepath.Join(append(append([]string{home}, fallback...), "tabs_server")...)
+}
+
+// writes data to a temp file next to filename and renames it into place
+func writeFileAtomic(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// How clients see incognito tabs and downloads
+const (
+	// everything, as the browser reports it
+	IncognitoShow = "show"
+	// everything to profiles with ScopeIncognito; nothing to the rest
+	IncognitoPrivileged = "privileged"
+	// the tabs themselves, but with their url, title and icon replaced
+	IncognitoMask = "mask"
+	// nothing
+	IncognitoDrop = "drop"
+)
+
+var (
+	// one of the Incognito* policies
+	// under any policy but IncognitoShow, incognito urls and titles are
+	// kept out of the log and nothing about them is written to disk
+	IncognitoPolicy = IncognitoPrivileged
+	// what masked tabs show instead
+	maskedUrl   = "about:privatebrowsing"
+	maskedTitle = "Private Browsing"
+)
+
+func checkIncognitoPolicy(policy string) error {
+	switch policy {
+	case IncognitoShow, IncognitoPrivileged, IncognitoMask, IncognitoDrop:
+		return nil
+	}
+	return fmt.Errorf("unknown incognito policy %q", policy)
+}
+
+// what the profile sees of incognito tabs: IncognitoShow, IncognitoMask or
+// IncognitoDrop
+func incognitoView(profile *Profile) string {
+	if IncognitoPolicy == IncognitoPrivileged {
+		if profile.Allows(ScopeIncognito) {
+			return IncognitoShow
+		}
+		return IncognitoDrop
+	}
+	return IncognitoPolicy
+}
+
+// whether incognito tabs may be logged and persisted
+func incognitoPrivate() bool {
+	return IncognitoPolicy != IncognitoShow
+}
+
+// the url to log for tab
+func loggedUrl(tab *Tab) string {
+	if tab.Incognito && incognitoPrivate() {
+		return "(private)"
+	}
+	return tab.Url
+}
+
+func maskTab(tab *Tab) *Tab {
+	masked := *tab
+	masked.Url = maskedUrl
+	masked.Title = maskedTitle
+	masked.FavIconUrl = ""
+	masked.FavIconFile = ""
+	masked.FavIconFileUrl = ""
+	return &masked
+}
+
+// returns tabs as the view allows them to be seen
+func redactTabs(tabs []*Tab, view string) []*Tab {
+	if view == IncognitoShow {
+		return tabs
+	}
+	redacted := make([]*Tab, 0, len(tabs))
+	for _, tab := range tabs {
+		switch {
+		case !tab.Incognito:
+			redacted = append(redacted, tab)
+		case view == IncognitoMask:
+			redacted = append(redacted, maskTab(tab))
+		}
+	}
+	return redacted
+}
+
+func maskDownload(item *DownloadItem) *DownloadItem {
+	masked := *item
+	masked.Url = maskedUrl
+	masked.Filename = ""
+	return &masked
+}
+
+func redactDownloads(items []*DownloadItem, view string) []*DownloadItem {
+	if view == IncognitoShow {
+		return items
+	}
+	redacted := make([]*DownloadItem, 0, len(items))
+	for _, item := range items {
+		switch {
+		case !item.Incognito:
+			redacted = append(redacted, item)
+		case view == IncognitoMask:
+			redacted = append(redacted, maskDownload(item))
+		}
+	}
+	return redacted
+}
+
+// methods that act on the active tab of the current window when given no
+// tab
+var activeTabMethods = map[string]bool{
+	"update":           true,
+	"reload":           true,
+	"captureTab":       true,
+	"executeScript":    true,
+	"insertCSS":        true,
+	"removeCSS":        true,
+	"extract":          true,
+	"toggleReaderMode": true,
+	"goBack":           true,
+	"goForward":        true,
+}
+
+// returns an error like the browser's for a missing tab or download if
+// request acts on an incognito one, or nil if it doesn't
+// must be called from the event loop
+func (g *Gateway) incognitoTarget(request *Request) error {
+	tabIds := request.TabIds
+	if request.TabId != 0 {
+		tabIds = append([]int{request.TabId}, tabIds...)
+	}
+	for _, tabId := range tabIds {
+		if tab, exists := g.tabs.Open[tabId]; exists && tab.Incognito {
+			return fmt.Errorf("Invalid tab ID: %d", tabId)
+		}
+	}
+	if len(tabIds) == 0 && activeTabMethods[request.Method] && g.incognitoActive() {
+		return errors.New("No current tab")
+	}
+	if request.DownloadId != 0 {
+		if item, exists := g.tabs.Downloads[request.DownloadId]; exists && item.Incognito {
+			return fmt.Errorf("Invalid download id %d", request.DownloadId)
+		}
+	}
+	return nil
+}
+
+// whether the active tab of the current window is incognito
+// until we learn which window has focus, any active incognito tab counts
+func (g *Gateway) incognitoActive() bool {
+	focused := g.activity.focusedWindow
+	for _, tab := range g.tabs.Open {
+		if tab.Active && tab.Incognito && (focused <= 0 || tab.WindowId == focused) {
+			return true
+		}
+	}
+	return false
+}
+
+// whether event concerns an incognito tab or download
+// must be called before the event is applied, so that tabs and downloads
+// it removes can still be looked up
+func privateEvent(store *TabStore, event Event) bool {
+	switch e := event.(type) {
+	case *CreatedMsg:
+		return e.Incognito
+	case *DownloadCreatedMsg:
+		return e.Incognito
+	case *DownloadChangedMsg:
+		item, exists := store.Downloads[e.ID]
+		return exists && item.Incognito
+	case *DownloadProgressMsg:
+		item, exists := store.Downloads[e.ID]
+		return exists && item.Incognito
+	case *DownloadErasedMsg:
+		item, exists := store.Downloads[e.ID]
+		return exists && item.Incognito
+	}
+	tab, exists := store.Open[eventTabId(event)]
+	return exists && tab.Incognito
+}
+
+// returns event as the view allows it to be seen, or nil if it may not be
+// seen at all
+func redactEvent(event Event, private bool, view string) Event {
+	if !private || view == IncognitoShow {
+		return event
+	}
+	if view == IncognitoDrop {
+		return nil
+	}
+	switch e := event.(type) {
+	case *CreatedMsg:
+		return (*CreatedMsg)(maskTab((*Tab)(e)))
+	case *UpdatedMsg:
+		masked := *e
+		if masked.Delta.Url != nil {
+			masked.Delta.Url = &maskedUrl
+		}
+		if masked.Delta.Title != nil {
+			masked.Delta.Title = &maskedTitle
+		}
+		masked.Delta.FavIconUrl = nil
+		masked.Delta.FavIconFile = nil
+		masked.Delta.FavIconFileUrl = nil
+		return &masked
+	case *DownloadCreatedMsg:
+		return (*DownloadCreatedMsg)(maskDownload((*DownloadItem)(e)))
+	case *DownloadChangedMsg:
+		masked := *e
+		if masked.Url != nil {
+			masked.Url = &Change[string]{Previous: maskedUrl, Current: maskedUrl}
+		}
+		masked.Filename = nil
+		return &masked
+	}
+	return event
+}
+
+// redacts the tabs or downloads in the response to a query or
+// listDownloads request before passing it on
+func redactResponse(method, view string, in <-chan *Message, out chan<- *Message) {
+	msg := <-in
+	if response := msg.Response; response != nil && response.Status == "success" {
+		var info any
+		var err error
+		switch method {
+		case "query":
+			var tabs []*Tab
+			if err = json.Unmarshal(response.Info, &tabs); err == nil {
+				info = redactTabs(tabs, view)
+			}
+		case "listDownloads":
+			var items []*DownloadItem
+			if err = json.Unmarshal(response.Info, &items); err == nil {
+				info = redactDownloads(items, view)
+			}
+		}
+		if err == nil {
+			response.Info, err = json.Marshal(info)
+		}
+		if err != nil {
+			// better to tell the client nothing than something private
+			log.Printf("ERROR: failed to redact %s response: %v", method, err)
+			msg = &Message{Response: errorResponse(response.ID, fmt.Errorf("failed to redact %s response", method))}
+		}
+	}
+	out <- msg
+}
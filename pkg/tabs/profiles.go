@@ -0,0 +1,204 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var (
+	ProfilesFile = filepath.Join(configDir(), "profiles.json")
+)
+
+// What a client may do
+const (
+	// list tabs, containers, downloads and groups, and receive events
+	ScopeRead = "read"
+	// open, update, move, reload, hide and discard tabs and the like
+	ScopeNavigate = "navigate"
+	// close tabs, remove containers and groups, cancel downloads
+	ScopeDestructive = "destructive"
+	// run code in pages or read what they contain
+	ScopeScript = "script"
+	// see incognito tabs and downloads when IncognitoPolicy is
+	// IncognitoPrivileged
+	ScopeIncognito = "incognito"
+	// everything, including methods added after the profile was written
+	ScopeAll = "*"
+)
+
+// the scope each method needs; methods not listed need ScopeAll
+var methodScopes = map[string]string{
+	"list":             ScopeRead,
+	"query":            ScopeRead,
+	"listContainers":   ScopeRead,
+	"listDownloads":    ScopeRead,
+	"listGroups":       ScopeRead,
+	"create":           ScopeNavigate,
+	"createWindow":     ScopeNavigate,
+	"duplicate":        ScopeNavigate,
+	"update":           ScopeNavigate,
+	"move":             ScopeNavigate,
+	"reload":           ScopeNavigate,
+	"discard":          ScopeNavigate,
+	"hide":             ScopeNavigate,
+	"show":             ScopeNavigate,
+	"toggleReaderMode": ScopeNavigate,
+	"goForward":        ScopeNavigate,
+	"goBack":           ScopeNavigate,
+	"createContainer":  ScopeNavigate,
+	"updateContainer":  ScopeNavigate,
+	"download":         ScopeNavigate,
+	"pauseDownload":    ScopeNavigate,
+	"resumeDownload":   ScopeNavigate,
+	"createGroup":      ScopeNavigate,
+	"assignGroup":      ScopeNavigate,
+	"switchGroup":      ScopeNavigate,
+	"remove":           ScopeDestructive,
+	"removeContainer":  ScopeDestructive,
+	"cancelDownload":   ScopeDestructive,
+	"removeGroup":      ScopeDestructive,
+	"captureTab":       ScopeScript,
+	"executeScript":    ScopeScript,
+	"insertCSS":        ScopeScript,
+	"removeCSS":        ScopeScript,
+	"extract":          ScopeScript,
+}
+
+// A named set of scopes that a client gets by authenticating with its token
+type Profile struct {
+	Name   string   `json:"-"`
+	Token  string   `json:"token"`
+	Scopes []string `json:"scopes"`
+}
+
+// e.g.
+//
+//	{
+//	  "default": "statusbar",
+//	  "profiles": {
+//	    "statusbar": {"token": "...", "scopes": ["read"]},
+//	    "editor": {"token": "...", "scopes": ["read", "navigate", "script"]}
+//	  }
+//	}
+type Profiles struct {
+	// the profile for clients that don't authenticate; full access if empty
+	Default  string              `json:"default,omitempty"`
+	Profiles map[string]*Profile `json:"profiles"`
+}
+
+// what clients get when no profile restricts them
+var fullAccess = &Profile{Name: "full", Scopes: []string{ScopeAll}}
+
+func LoadProfiles(filename string) (*Profiles, error) {
+	profiles := &Profiles{Profiles: map[string]*Profile{}}
+	info, err := os.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return profiles, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("%s holds tokens and must not be readable by other users", filename)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, profiles); err != nil {
+		return nil, fmt.Errorf("Failed to parse profiles: %w", err)
+	}
+	for name, profile := range profiles.Profiles {
+		profile.Name = name
+		for _, scope := range profile.Scopes {
+			switch scope {
+			case ScopeRead, ScopeNavigate, ScopeDestructive, ScopeScript, ScopeIncognito, ScopeAll:
+			default:
+				return nil, fmt.Errorf("profile %s: unknown scope %q", name, scope)
+			}
+		}
+	}
+	if profiles.Default != "" {
+		if _, exists := profiles.Profiles[profiles.Default]; !exists {
+			return nil, fmt.Errorf("default profile %s is not defined", profiles.Default)
+		}
+	}
+	return profiles, nil
+}
+
+// the profile for clients that have not authenticated
+func (p *Profiles) unauthenticated() *Profile {
+	if profile, exists := p.Profiles[p.Default]; exists {
+		return profile
+	}
+	return fullAccess
+}
+
+// returns the profile the request's credentials prove the client has
+// a request naming no profile may present GatewayToken for full access
+func (p *Profiles) authenticate(request *Request) (*Profile, error) {
+	if request.Profile == "" {
+		if GatewayToken != "" && tokenMatches(GatewayToken, request.Token) {
+			return fullAccess, nil
+		}
+		return nil, errors.New("invalid token")
+	}
+	profile, exists := p.Profiles[request.Profile]
+	if !exists || profile.Token == "" || !tokenMatches(profile.Token, request.Token) {
+		// don't reveal which profiles exist
+		return nil, errors.New("invalid profile or token")
+	}
+	return profile, nil
+}
+
+func (p *Profile) Allows(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == ScopeAll || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// returns a *ScopeError if the profile may not call method
+func (p *Profile) check(method string) error {
+	if method == "authenticate" {
+		return nil
+	}
+	scope, exists := methodScopes[method]
+	if !exists {
+		scope = ScopeAll
+	}
+	if p.Allows(scope) {
+		return nil
+	}
+	return &ScopeError{Method: method, Scope: scope, Profile: p.Name}
+}
+
+// Returned to clients that call a method their profile doesn't allow,
+// as the Info of a response with status "denied"
+type ScopeError struct {
+	Method  string `json:"method"`
+	Scope   string `json:"scope"`
+	Profile string `json:"profile"`
+}
+
+func (e *ScopeError) Error() string {
+	return fmt.Sprintf("profile %s may not call %s, which needs scope %s", e.Profile, e.Method, e.Scope)
+}
+
+func deniedResponse(request *Request, err *ScopeError) *Response {
+	info, _ := json.Marshal(err)
+	return &Response{ID: request.ID, Status: "denied", Info: info}
+}
+
+// the error carried by a denied response
+func scopeError(response *Response) error {
+	var err ScopeError
+	if jsonErr := json.Unmarshal(response.Info, &err); jsonErr != nil {
+		return fmt.Errorf("permission denied: %s", string(response.Info))
+	}
+	return &err
+}
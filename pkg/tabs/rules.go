@@ -0,0 +1,220 @@
+package tabs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	RulesFile = filepath.Join(configDir(), "rules.json")
+	// how often rules are checked against every open tab
+	RulesInterval = time.Minute
+)
+
+// A duration written as "90s", "1h" etc in the rules file
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// All set fields must match for the rule to apply
+// Url and Title are regular expressions
+type RuleMatch struct {
+	Url       string `json:"url,omitempty"`
+	Title     string `json:"title,omitempty"`
+	Container string `json:"container,omitempty"`
+	// not activated for at least this long; the active tab never matches
+	IdleFor *Duration `json:"idleFor,omitempty"`
+	Audible *bool     `json:"audible,omitempty"`
+	Pinned  *bool     `json:"pinned,omitempty"`
+}
+
+// e.g.
+//
+//	{"name": "park idle tabs", "match": {"idleFor": "1h"}, "action": "discard"}
+//	{"name": "pin chat", "match": {"url": "^https://app\\.slack\\.com/"}, "action": "pin"}
+//	{"name": "quiet news", "match": {"url": "cnn\\.com", "audible": true}, "action": "mute"}
+type Rule struct {
+	Name  string    `json:"name"`
+	Match RuleMatch `json:"match"`
+	// one of discard, close, pin, mute, move, hide
+	Action string `json:"action"`
+	// target of the move action
+	WindowId int `json:"windowId,omitempty"`
+
+	urlRe   *regexp.Regexp
+	titleRe *regexp.Regexp
+}
+
+func LoadRules(filename string) ([]*Rule, error) {
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var rules []*Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("Failed to parse rules: %w", err)
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = strconv.Itoa(i)
+		}
+		if err := rule.compile(); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+func (r *Rule) compile() (err error) {
+	switch r.Action {
+	case "discard", "close", "pin", "mute", "hide":
+	case "move":
+		if r.WindowId == 0 {
+			return errors.New("move requires windowId")
+		}
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	if r.Match.Url != "" {
+		if r.urlRe, err = regexp.Compile(r.Match.Url); err != nil {
+			return err
+		}
+	}
+	if r.Match.Title != "" {
+		if r.titleRe, err = regexp.Compile(r.Match.Title); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Rule) Matches(tab *Tab, now time.Time) bool {
+	m := r.Match
+	if r.urlRe != nil && !r.urlRe.MatchString(tab.Url) {
+		return false
+	}
+	if r.titleRe != nil && !r.titleRe.MatchString(tab.Title) {
+		return false
+	}
+	if m.Container != "" && m.Container != tab.CookieStoreId {
+		return false
+	}
+	if m.Audible != nil && *m.Audible != tab.Audible {
+		return false
+	}
+	if m.Pinned != nil && *m.Pinned != tab.Pinned {
+		return false
+	}
+	if m.IdleFor != nil {
+		lastAccessed := time.UnixMilli(int64(tab.LastAccessed))
+		if tab.Active || now.Sub(lastAccessed) < time.Duration(*m.IdleFor) {
+			return false
+		}
+	}
+	return true
+}
+
+// whether the tab is already in the state the action would put it in
+func (r *Rule) satisfied(tab *Tab) bool {
+	switch r.Action {
+	case "discard":
+		// the browser will not discard the active tab
+		return tab.Discarded || tab.Active
+	case "pin":
+		return tab.Pinned
+	case "mute":
+		return tab.MutedInfo != nil && tab.MutedInfo.Muted
+	case "move":
+		return tab.WindowId == r.WindowId
+	case "hide":
+		return tab.Hidden || tab.Active
+	}
+	return false
+}
+
+func (r *Rule) request(tabId int) *Request {
+	switch r.Action {
+	case "discard":
+		return &Request{Method: "discard", TabIds: []int{tabId}}
+	case "close":
+		return &Request{Method: "remove", TabIds: []int{tabId}}
+	case "pin":
+		return &Request{Method: "update", TabId: tabId, Props: &UpdateProperties{Pinned: ptr(true)}}
+	case "mute":
+		return &Request{Method: "update", TabId: tabId, Props: &UpdateProperties{Muted: ptr(true)}}
+	case "move":
+		return &Request{Method: "move", TabId: tabId, Props: &MoveProperties{WindowId: r.WindowId, Index: -1}}
+	case "hide":
+		return &Request{Method: "hide", TabIds: []int{tabId}}
+	}
+	return nil
+}
+
+// checks the rules against the tabs and acts on any that match
+// must be called from the gateway's event loop
+func (g *Gateway) evaluateRules(tabs []*Tab) {
+	if len(g.rules) == 0 {
+		return
+	}
+	now := time.Now()
+	g.expireActions(now)
+	for _, tab := range tabs {
+		for _, rule := range g.rules {
+			if !rule.Matches(tab, now) || rule.satisfied(tab) {
+				continue
+			}
+			if !g.startAction(fmt.Sprintf("rule/%s/%d", rule.Name, tab.ID), now) {
+				continue
+			}
+			log.Printf("Rule %s: %s tab %d (%s)", rule.Name, rule.Action, tab.ID, loggedUrl(tab))
+			// the response arrives through the event loop, so don't wait on it here
+			go g.act(fmt.Sprintf("rule %s on tab %d", rule.Name, tab.ID), rule.request(tab.ID))
+			if rule.Action == "close" {
+				break
+			}
+		}
+	}
+}
+
+// returns the id of the tab the event is about
+func eventTabId(event Event) int {
+	switch e := event.(type) {
+	case *CreatedMsg:
+		return e.ID
+	case *ActivatedMsg:
+		return e.TabId
+	case *UpdatedMsg:
+		return e.TabId
+	case *MovedMsg:
+		return e.TabId
+	case *RemovedMsg:
+		return e.TabId
+	case *AttachedMsg:
+		return e.TabId
+	}
+	return -1
+}
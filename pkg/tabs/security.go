@@ -0,0 +1,196 @@
+package tabs
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	// clients on transports other than unix sockets must send this, or the
+	// token of a profile, in an authenticate request before anything else;
+	// empty disables the check
+	GatewayToken = ""
+	// read by LoadToken when TABS_SERVER_TOKEN is not set
+	TokenFile = filepath.Join(configDir(), "token")
+	// how long a client has to authenticate
+	authTimeout = 10 * time.Second
+)
+
+// returns the token from the environment or TokenFile, or "" if neither
+// has one
+func LoadToken() (string, error) {
+	if token := os.Getenv("TABS_SERVER_TOKEN"); token != "" {
+		return token, nil
+	}
+	info, err := os.Stat(TokenFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("%s must not be readable by other users", TokenFile)
+	}
+	data, err := os.ReadFile(TokenFile)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+func tokenMatches(want, got string) bool {
+	return subtle.ConstantTimeCompare([]byte(want), []byte(got)) == 1
+}
+
+// whether host, from a Host header, names us on port rather than some
+// domain that resolves to us
+func allowedHost(host, port string) bool {
+	name, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		name, hostPort = host, "80"
+	}
+	if port != "" && hostPort != port {
+		return false
+	}
+	if strings.EqualFold(name, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(name)
+	return ip != nil && ip.IsLoopback()
+}
+
+// whether r carries "Authorization: Bearer GatewayToken", or GatewayToken
+// is not set
+func bearerAuthorized(r *http.Request) bool {
+	if GatewayToken == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	return strings.HasPrefix(header, "Bearer ") && tokenMatches(GatewayToken, strings.TrimPrefix(header, "Bearer "))
+}
+
+// creates dir, or fixes up an existing one, so that only we can use it
+func makePrivateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if uid, known := fileOwner(info); known && uid != os.Getuid() {
+		return fmt.Errorf("%s is owned by uid %d, not us", dir, uid)
+	}
+	if info.Mode().Perm() != 0700 {
+		return os.Chmod(dir, 0700)
+	}
+	return nil
+}
+
+// listens on a unix socket that only we can connect to
+func listenUnix(path string) (net.Listener, error) {
+	if err := makePrivateDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return nil, err
+	}
+	// the directory keeps others out until the chmod below; changing the
+	// umask instead would affect every goroutine creating files
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// refuses unix socket peers running as another user
+// permissions should already keep them out; this guards against the
+// socket being created or moved somewhere less private
+func checkPeer(conn net.Conn) error {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	uid, err := peerUid(unixConn)
+	if errors.Is(err, errPeerCredUnsupported) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if uid != os.Getuid() {
+		return fmt.Errorf("peer uid %d does not match ours", uid)
+	}
+	return nil
+}
+
+var errPeerCredUnsupported = errors.New("peer credentials not supported on this platform")
+
+type authResult struct {
+	profile *Profile
+	err     error
+}
+
+// waits for the client to send a token and returns the profile it grants
+// clients that don't are told why and should be closed
+func authenticate(conn clientConn, profiles *Profiles) (*Profile, error) {
+	result := make(chan authResult, 1)
+	go func() {
+		msg, err := conn.ReadMsg()
+		if err == io.EOF {
+			result <- authResult{err: err}
+			return
+		} else if err != nil {
+			result <- authResult{err: fmt.Errorf("reading authenticate request: %w", err)}
+			return
+		}
+		request := msg.Request
+		if request == nil || request.Method != "authenticate" {
+			err := errors.New("authenticate must be the first request")
+			if request != nil {
+				conn.SendMsg(&Message{Response: errorResponse(request.ID, err)})
+			}
+			result <- authResult{err: err}
+			return
+		}
+		profile, err := profiles.authenticate(request)
+		if err != nil {
+			conn.SendMsg(&Message{Response: errorResponse(request.ID, err)})
+			result <- authResult{err: err}
+			return
+		}
+		conn.SendMsg(&Message{Response: &Response{ID: request.ID, Status: "success"}})
+		result <- authResult{profile: profile}
+	}()
+	select {
+	case r := <-result:
+		return r.profile, r.err
+	case <-time.After(authTimeout):
+		// closing the connection unblocks the reader
+		return nil, errors.New("timed out waiting to authenticate")
+	}
+}
+
+// logs that the transport at addr is open to anything on this machine
+func warnNoToken(transport, addr string) {
+	if GatewayToken == "" {
+		log.Printf("WARNING: %s at %s accepts any local client; set TABS_SERVER_TOKEN or %s to require a token",
+			transport, addr, TokenFile)
+	}
+}
@@ -2,6 +2,8 @@ package tabs
 
 import (
 	"fmt"
+	"sort"
+	"time"
 )
 
 // The structs exactly as they come over the wire
@@ -34,7 +36,8 @@ type Tab struct {
 	Url            string        `json:"url"`
 	Title          string        `json:"title"`
 	FavIconUrl     string        `json:"favIconUrl"`
-	FavIconFile    string		 `json:"favIconFile,omitempty"`
+	FavIconFile    string        `json:"favIconFile,omitempty"`
+	FavIconFileUrl string        `json:"favIconFileUrl,omitempty"`
 	Status         string        `json:"status"`
 	Discarded      bool          `json:"discarded"`
 	Incognito      bool          `json:"incognito"`
@@ -51,19 +54,20 @@ type Tab struct {
 }
 
 type TabDelta struct {
-	Attention    *bool         `json:"attention,omitempty"`
-	Audible      *bool         `json:"audible,omitempty"`
-	Discarded    *bool         `json:"discarded,omitempty"`
-	FavIconUrl   *string       `json:"favIconUrl,omitempty"`
-	FavIconFile  *string	   `json:"favIconFile,omitempty"`
-	Hidden       *bool         `json:"hidden,omitempty"`
-	IsArticle    *bool         `json:"isArticle,omitempty"`
-	MutedInfo    *MutedInfo    `json:"mutedInfo,omitempty"`
-	Pinned       *bool         `json:"pinned,omitempty"`
-	SharingState *SharingState `json:"sharingState,omitempty"`
-	Status       *string       `json:"status,omitempty"`
-	Title        *string       `json:"title,omitempty"`
-	Url          *string       `json:"url,omitempty"`
+	Attention      *bool         `json:"attention,omitempty"`
+	Audible        *bool         `json:"audible,omitempty"`
+	Discarded      *bool         `json:"discarded,omitempty"`
+	FavIconUrl     *string       `json:"favIconUrl,omitempty"`
+	FavIconFile    *string       `json:"favIconFile,omitempty"`
+	FavIconFileUrl *string       `json:"favIconFileUrl,omitempty"`
+	Hidden         *bool         `json:"hidden,omitempty"`
+	IsArticle      *bool         `json:"isArticle,omitempty"`
+	MutedInfo      *MutedInfo    `json:"mutedInfo,omitempty"`
+	Pinned         *bool         `json:"pinned,omitempty"`
+	SharingState   *SharingState `json:"sharingState,omitempty"`
+	Status         *string       `json:"status,omitempty"`
+	Title          *string       `json:"title,omitempty"`
+	Url            *string       `json:"url,omitempty"`
 }
 
 // Events
@@ -100,21 +104,25 @@ func (_ *ActivatedMsg) Name() string {
 }
 
 func (msg *ActivatedMsg) Apply(store *TabStore) error {
+	// the browser doesn't report lastAccessed changes, so track them here
+	now := int(time.Now().UnixMilli())
 	// do we care if the previously active tab isn't found?
 	if previous, exists := store.Open[msg.Previous]; exists {
 		previous.Active = false
+		previous.LastAccessed = now
 	}
 	tab, err := store.Get(msg.TabId)
 	if err != nil {
 		return fmt.Errorf("ERROR: Activate: %v", err)
 	}
 	tab.Active = true
+	tab.LastAccessed = now
 	return nil
 }
 
 type UpdatedMsg struct {
-	TabId int       `json:"tabId"`
-	Delta TabDelta  `json:"delta"`
+	TabId int      `json:"tabId"`
+	Delta TabDelta `json:"delta"`
 }
 
 func (_ *UpdatedMsg) Name() string {
@@ -142,6 +150,9 @@ func (msg *UpdatedMsg) Apply(store *TabStore) error {
 	if d.FavIconFile != nil {
 		tab.FavIconFile = *d.FavIconFile
 	}
+	if d.FavIconFileUrl != nil {
+		tab.FavIconFileUrl = *d.FavIconFileUrl
+	}
 	if d.Hidden != nil {
 		tab.Hidden = *d.Hidden
 	}
@@ -179,6 +190,7 @@ type MovedMsg struct {
 func (_ *MovedMsg) Name() string {
 	return "updated"
 }
+
 // do reshuffled tabs get moved?
 func (msg *MovedMsg) Apply(store *TabStore) error {
 	tab, err := store.Get(msg.TabId)
@@ -232,10 +244,19 @@ func (msg *AttachedMsg) Apply(store *TabStore) error {
 type TabStore struct {
 	Open   map[int]*Tab
 	Closed []*Tab
+	// by CookieStoreId; only kept up to date by container events
+	Containers map[string]*Container
+	// by id; only kept up to date by download events
+	Downloads map[int]*DownloadItem
 }
 
 func MakeTabStore() *TabStore {
-	return &TabStore{Open: make(map[int]*Tab), Closed: []*Tab{}}
+	return &TabStore{
+		Open:       make(map[int]*Tab),
+		Closed:     []*Tab{},
+		Containers: make(map[string]*Container),
+		Downloads:  make(map[int]*DownloadItem),
+	}
 }
 
 func (s *TabStore) Get(id int) (*Tab, error) {
@@ -254,3 +275,28 @@ func (s *TabStore) List() []*Tab {
 	}
 	return tabList
 }
+
+// returns the open tabs grouped by window, ordered by window id and
+// then by position within the window
+// incognito tabs are never included
+func (s *TabStore) Windows(filter func(*Tab) bool) [][]*Tab {
+	byWindow := make(map[int][]*Tab)
+	for _, tab := range s.Open {
+		if tab.Incognito || (filter != nil && !filter(tab)) {
+			continue
+		}
+		byWindow[tab.WindowId] = append(byWindow[tab.WindowId], tab)
+	}
+	windowIds := make([]int, 0, len(byWindow))
+	for id := range byWindow {
+		windowIds = append(windowIds, id)
+	}
+	sort.Ints(windowIds)
+	windows := make([][]*Tab, len(windowIds))
+	for i, id := range windowIds {
+		tabs := byWindow[id]
+		sort.Slice(tabs, func(i, j int) bool { return tabs[i].Index < tabs[j].Index })
+		windows[i] = tabs
+	}
+	return windows
+}
@@ -0,0 +1,105 @@
+package tabs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// address for accepting clients over WebSocket, e.g. "127.0.0.1:7072"
+	// empty disables the listener
+	GatewayWebSocketAddr = ""
+	// origins allowed to connect from a browser; "*" allows any
+	// clients that send no Origin header are always allowed
+	GatewayWebSocketOrigins = []string{}
+)
+
+// A client on a WebSocket carrying one Message as JSON per text frame
+type wsConn struct {
+	conn *websocket.Conn
+	// guards writes; gorilla allows only one concurrent writer
+	mu sync.Mutex
+}
+
+func (c *wsConn) ReadMsg() (*Message, error) {
+	for {
+		msgType, data, err := c.conn.ReadMessage()
+		if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, err
+		}
+		if msgType != websocket.TextMessage {
+			log.Printf("ERROR: ignoring non-text frame from %s", c)
+			continue
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(data, msg); err != nil {
+			// the next frame is still intact
+			return nil, &BadMsgError{Err: err}
+		}
+		return msg, nil
+	}
+}
+
+func (c *wsConn) SendMsg(msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *wsConn) String() string {
+	return fmt.Sprintf("websocket %s", c.conn.RemoteAddr())
+}
+
+func allowedOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range GatewayWebSocketOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// accepts clients at ws://addr/ws until the listener fails
+func (g *Gateway) listenWebSocket(addr string) error {
+	l, err := listenLoopback(addr)
+	if err != nil {
+		return err
+	}
+	upgrader := websocket.Upgrader{CheckOrigin: allowedOrigin}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade has already replied with an error
+			log.Printf("ERROR: websocket upgrade: %v", err)
+			return
+		}
+		// larger frames fail the read and so close the connection
+		conn.SetReadLimit(int64(MaxBrowserMsgSize))
+		g.addConn(&wsConn{conn: conn}, true)
+	})
+	log.Printf("Accepting WebSocket clients at ws://%s/ws", l.Addr())
+	warnNoToken("WebSocket listener", addr)
+	return http.Serve(l, mux)
+}
@@ -0,0 +1,189 @@
+package tabs
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var (
+	WorkspaceDir = filepath.Join(dataDir(), "workspaces")
+)
+
+// A saved set of tabs that can be reopened later
+type Workspace struct {
+	Name    string            `json:"name"`
+	Saved   time.Time         `json:"saved"`
+	Windows []WorkspaceWindow `json:"windows"`
+}
+
+type WorkspaceWindow struct {
+	Tabs []WorkspaceTab `json:"tabs"`
+}
+
+type WorkspaceTab struct {
+	Url           string `json:"url"`
+	Title         string `json:"title"`
+	Pinned        bool   `json:"pinned,omitempty"`
+	CookieStoreId string `json:"cookieStoreId,omitempty"`
+}
+
+// returns a filter matching tabs whose url or title contains text
+func TabFilter(text string) func(*Tab) bool {
+	text = strings.ToLower(text)
+	return func(tab *Tab) bool {
+		return strings.Contains(strings.ToLower(tab.Url), text) ||
+			strings.Contains(strings.ToLower(tab.Title), text)
+	}
+}
+
+// returns the open tabs as a workspace, keeping window grouping and order
+// if filter is non-nil only tabs it matches are included
+func (s *TabStore) Workspace(name string, filter func(*Tab) bool) *Workspace {
+	ws := &Workspace{Name: name, Saved: time.Now()}
+	for _, tabs := range s.Windows(filter) {
+		window := WorkspaceWindow{}
+		for _, tab := range tabs {
+			window.Tabs = append(window.Tabs, WorkspaceTab{
+				Url:           tab.Url,
+				Title:         tab.Title,
+				Pinned:        tab.Pinned,
+				CookieStoreId: tab.CookieStoreId,
+			})
+		}
+		ws.Windows = append(ws.Windows, window)
+	}
+	return ws
+}
+
+func workspaceFile(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || strings.HasPrefix(name, ".") {
+		return "", fmt.Errorf("Invalid workspace name %q", name)
+	}
+	return filepath.Join(WorkspaceDir, name+".json"), nil
+}
+
+func SaveWorkspace(ws *Workspace) error {
+	filename, err := workspaceFile(ws.Name)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(ws, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filename, data)
+}
+
+func LoadWorkspace(name string) (*Workspace, error) {
+	filename, err := workspaceFile(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read workspace %s: %w", name, err)
+	}
+	var ws Workspace
+	if err := json.Unmarshal(data, &ws); err != nil {
+		return nil, fmt.Errorf("Failed to parse workspace %s: %w", name, err)
+	}
+	return &ws, nil
+}
+
+func ListWorkspaces() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(WorkspaceDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(files))
+	for i, file := range files {
+		names[i] = strings.TrimSuffix(filepath.Base(file), ".json")
+	}
+	return names, nil
+}
+
+type OpenOptions struct {
+	// open every tab in this window rather than the current one
+	WindowId *int
+	// open each window after the first in a new browser window;
+	// otherwise everything goes into one window
+	NewWindows bool
+	// create tabs without loading them
+	Discarded bool
+	// pin every tab, in addition to those saved as pinned
+	Pinned bool
+	// if positive, pause for BatchDelay after every BatchSize tabs so
+	// the browser is not flooded
+	BatchSize  int
+	BatchDelay time.Duration
+}
+
+// reopens the workspace's tabs
+// the first window is restored into the current window and the rest
+// into new windows; tabs are created discarded so nothing loads until
+// it is activated
+func (client *TabsClient) RestoreWorkspace(ws *Workspace) error {
+	return client.OpenWorkspace(ws, OpenOptions{NewWindows: true, Discarded: true})
+}
+
+// opens the workspace's tabs as directed by opts
+// tabs that fail to open are logged and skipped
+func (client *TabsClient) OpenWorkspace(ws *Workspace, opts OpenOptions) error {
+	opened := 0
+	for i, window := range ws.Windows {
+		windowId := opts.WindowId
+		var blankTabs []int
+		if i > 0 && opts.NewWindows {
+			newWindow, err := client.CreateWindow()
+			if err != nil {
+				return err
+			}
+			windowId = &newWindow.ID
+			for _, tab := range newWindow.Tabs {
+				blankTabs = append(blankTabs, tab.ID)
+			}
+		}
+		for _, tab := range window.Tabs {
+			if opts.BatchSize > 0 && opened > 0 && opened%opts.BatchSize == 0 {
+				time.Sleep(opts.BatchDelay)
+			}
+			if _, err := client.Create(workspaceTabProperties(tab, windowId, opts)); err != nil {
+				log.Printf("failed to open %s: %v", tab.Url, err)
+				continue
+			}
+			opened++
+		}
+		if len(blankTabs) > 0 {
+			if err := client.Close(blankTabs[0], blankTabs[1:]...); err != nil {
+				log.Printf("failed to close new window's initial tab: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+func workspaceTabProperties(tab WorkspaceTab, windowId *int, opts OpenOptions) CreateProperties {
+	props := CreateProperties{
+		WindowId: windowId,
+		Url:      ptr(tab.Url),
+		Active:   ptr(false),
+	}
+	if tab.Pinned || opts.Pinned {
+		props.Pinned = ptr(true)
+	} else if opts.Discarded && (strings.HasPrefix(tab.Url, "http:") || strings.HasPrefix(tab.Url, "https:")) {
+		// the browser refuses to create pinned or privileged pages discarded
+		props.Discarded = ptr(true)
+		if tab.Title != "" {
+			props.Title = ptr(tab.Title)
+		}
+	}
+	if tab.CookieStoreId != "" && tab.CookieStoreId != "firefox-default" {
+		props.CookieStoreId = ptr(tab.CookieStoreId)
+	}
+	return props
+}